@@ -0,0 +1,83 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package extension
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+// decompressAgentData returns the uncompressed ndjson body of the agent data
+func decompressAgentData(agentData AgentData) ([]byte, error) {
+	var reader io.ReadCloser
+	var err error
+	switch agentData.ContentEncoding {
+	case "", "identity":
+		return agentData.Data, nil
+	case "gzip":
+		reader, err = gzip.NewReader(bytes.NewReader(agentData.Data))
+	case "deflate":
+		reader, err = zlib.NewReader(bytes.NewReader(agentData.Data))
+	default:
+		return nil, fmt.Errorf("unsupported content encoding %q", agentData.ContentEncoding)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not decompress agent data: %v", err)
+	}
+	defer reader.Close()
+
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, fmt.Errorf("could not decompress agent data: %v", err)
+	}
+	return data, nil
+}
+
+// splitMetadata splits an uncompressed intake v2 body into its leading
+// metadata line and the event lines that follow it. The metadata is nil when
+// the body does not start with a metadata line.
+func splitMetadata(data []byte) (metadata []byte, events []byte) {
+	data = bytes.TrimLeft(data, " \t\r\n")
+	lineEnd := bytes.IndexByte(data, '\n')
+	firstLine := data
+	if lineEnd >= 0 {
+		firstLine = data[:lineEnd]
+	}
+	if !isMetadataLine(firstLine) {
+		return nil, data
+	}
+	if lineEnd < 0 {
+		return firstLine, nil
+	}
+	return firstLine, data[lineEnd+1:]
+}
+
+// isMetadataLine reports whether the ndjson line holds an intake v2 metadata object
+func isMetadataLine(line []byte) bool {
+	var event map[string]json.RawMessage
+	if err := json.Unmarshal(line, &event); err != nil {
+		return false
+	}
+	_, ok := event["metadata"]
+	return ok
+}
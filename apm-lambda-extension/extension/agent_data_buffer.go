@@ -0,0 +1,232 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package extension
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// OverflowPolicy decides what happens to agent data when the buffer is full
+type OverflowPolicy string
+
+const (
+	// OverflowBlock makes the agent request wait until there is room in the buffer
+	OverflowBlock OverflowPolicy = "block"
+
+	// OverflowDropNewest discards the incoming agent data, without letting the
+	// agent know
+	OverflowDropNewest OverflowPolicy = "drop_newest"
+
+	// OverflowDropOldest discards the oldest buffered agent data to make room
+	OverflowDropOldest OverflowPolicy = "drop_oldest"
+
+	// OverflowReject refuses the incoming agent data, and the agent receives
+	// a 503 response
+	OverflowReject OverflowPolicy = "reject"
+)
+
+// ErrBufferFull is returned when agent data is rejected by a full buffer
+var ErrBufferFull = errors.New("agent data buffer is full")
+
+// AgentDataBufferStats counts the agent data that did not make it into the buffer
+type AgentDataBufferStats struct {
+	DroppedNewest int
+	DroppedOldest int
+	Rejected      int
+	DroppedBytes  int
+}
+
+// AgentDataBuffer holds agent data until it is sent to the APM server. It is
+// bounded by both the number of payloads and their total size in bytes, and
+// applies its overflow policy to agent data that does not fit. A payload is
+// always accepted into an empty buffer, even if it exceeds the size limit on
+// its own, so that large payloads can still make their way through.
+type AgentDataBuffer struct {
+	sync.Mutex
+	items     []AgentData
+	size      int
+	maxItems  int
+	maxBytes  int
+	policy    OverflowPolicy
+	stats     AgentDataBufferStats
+	available chan struct{}
+	space     chan struct{}
+}
+
+// NewAgentDataBuffer returns an empty buffer. A limit of zero or less is not enforced.
+func NewAgentDataBuffer(maxItems int, maxBytes int, policy OverflowPolicy) *AgentDataBuffer {
+	return &AgentDataBuffer{
+		maxItems:  maxItems,
+		maxBytes:  maxBytes,
+		policy:    policy,
+		available: make(chan struct{}, 1),
+		space:     make(chan struct{}, 1),
+	}
+}
+
+// Add appends agent data to the buffer. With the block policy, it waits for
+// room in the buffer until done is closed, and then rejects the data.
+func (b *AgentDataBuffer) Add(agentData AgentData, done <-chan struct{}) error {
+	for {
+		b.Lock()
+		if !b.fits(agentData) {
+			switch b.policy {
+			case OverflowDropNewest:
+				b.stats.DroppedNewest++
+				b.stats.DroppedBytes += len(agentData.Data)
+				b.Unlock()
+				return nil
+			case OverflowDropOldest:
+				for !b.fits(agentData) {
+					b.stats.DroppedOldest++
+					b.stats.DroppedBytes += len(b.items[0].Data)
+					b.removeFirst()
+				}
+			case OverflowBlock:
+				b.Unlock()
+				select {
+				case <-b.space:
+					continue
+				case <-done:
+					b.Lock()
+					b.stats.Rejected++
+					b.stats.DroppedBytes += len(agentData.Data)
+					b.Unlock()
+					return ErrBufferFull
+				}
+			default:
+				b.stats.Rejected++
+				b.stats.DroppedBytes += len(agentData.Data)
+				b.Unlock()
+				return ErrBufferFull
+			}
+		}
+		b.items = append(b.items, agentData)
+		b.size += len(agentData.Data)
+		b.Unlock()
+		signal(b.available)
+		// Pass on the wake-up to other blocked writers, there may be room left
+		signal(b.space)
+		return nil
+	}
+}
+
+// Requeue puts agent data that could not be sent back at the front of the
+// buffer, in the given order. As it was admitted into the buffer before, it
+// is not subject to the buffer limits.
+func (b *AgentDataBuffer) Requeue(agentData ...AgentData) {
+	if len(agentData) == 0 {
+		return
+	}
+	b.Lock()
+	items := make([]AgentData, 0, len(agentData)+len(b.items))
+	items = append(items, agentData...)
+	b.items = append(items, b.items...)
+	for _, data := range agentData {
+		b.size += len(data.Data)
+	}
+	b.Unlock()
+	signal(b.available)
+}
+
+// TryGet removes and returns the oldest agent data, if there is any
+func (b *AgentDataBuffer) TryGet() (AgentData, bool) {
+	b.Lock()
+	defer b.Unlock()
+
+	if len(b.items) == 0 {
+		return AgentData{}, false
+	}
+	agentData := b.items[0]
+	b.removeFirst()
+	if len(b.items) > 0 {
+		signal(b.available)
+	}
+	return agentData, true
+}
+
+// Get removes and returns the oldest agent data, waiting for agent data to
+// be added if the buffer is empty. It gives up once done is closed.
+func (b *AgentDataBuffer) Get(done <-chan struct{}) (AgentData, bool) {
+	for {
+		if agentData, ok := b.TryGet(); ok {
+			return agentData, true
+		}
+		select {
+		case <-b.available:
+		case <-done:
+			return AgentData{}, false
+		}
+	}
+}
+
+// Len returns the number of payloads in the buffer
+func (b *AgentDataBuffer) Len() int {
+	b.Lock()
+	defer b.Unlock()
+	return len(b.items)
+}
+
+// Size returns the total size of the payloads in the buffer
+func (b *AgentDataBuffer) Size() int {
+	b.Lock()
+	defer b.Unlock()
+	return b.size
+}
+
+// Stats returns the counters of agent data dropped or rejected by the buffer
+func (b *AgentDataBuffer) Stats() AgentDataBufferStats {
+	b.Lock()
+	defer b.Unlock()
+	return b.stats
+}
+
+func (s AgentDataBufferStats) String() string {
+	return fmt.Sprintf("dropped newest: %d, dropped oldest: %d, rejected: %d, dropped bytes: %d",
+		s.DroppedNewest, s.DroppedOldest, s.Rejected, s.DroppedBytes)
+}
+
+// fits reports whether the agent data can be added without exceeding the
+// buffer limits. The lock must be held.
+func (b *AgentDataBuffer) fits(agentData AgentData) bool {
+	if len(b.items) == 0 {
+		return true
+	}
+	if b.maxItems > 0 && len(b.items)+1 > b.maxItems {
+		return false
+	}
+	return b.maxBytes <= 0 || b.size+len(agentData.Data) <= b.maxBytes
+}
+
+// removeFirst drops the oldest agent data. The lock must be held.
+func (b *AgentDataBuffer) removeFirst() {
+	b.size -= len(b.items[0].Data)
+	b.items[0] = AgentData{}
+	b.items = b.items[1:]
+	signal(b.space)
+}
+
+// signal wakes up a waiter on the channel without blocking
+func signal(c chan struct{}) {
+	select {
+	case c <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,133 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package extension
+
+import (
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+)
+
+func agentDataOfSize(size int) AgentData {
+	return AgentData{Data: make([]byte, size)}
+}
+
+func TestAgentDataBufferBoundedByBytes(t *testing.T) {
+	buffer := NewAgentDataBuffer(0, 10, OverflowReject)
+
+	assert.NilError(t, buffer.Add(agentDataOfSize(6), nil))
+	assert.Equal(t, ErrBufferFull, buffer.Add(agentDataOfSize(6), nil))
+	assert.NilError(t, buffer.Add(agentDataOfSize(4), nil))
+	assert.Equal(t, 2, buffer.Len())
+	assert.Equal(t, 10, buffer.Size())
+	assert.Equal(t, AgentDataBufferStats{Rejected: 1, DroppedBytes: 6}, buffer.Stats())
+}
+
+func TestAgentDataBufferAcceptsOversizedDataWhenEmpty(t *testing.T) {
+	buffer := NewAgentDataBuffer(0, 10, OverflowReject)
+
+	assert.NilError(t, buffer.Add(agentDataOfSize(20), nil))
+	assert.Equal(t, ErrBufferFull, buffer.Add(agentDataOfSize(1), nil))
+}
+
+func TestAgentDataBufferDropNewest(t *testing.T) {
+	buffer := NewAgentDataBuffer(2, 0, OverflowDropNewest)
+
+	for i := 1; i <= 3; i++ {
+		assert.NilError(t, buffer.Add(agentDataOfSize(i), nil))
+	}
+	first, _ := buffer.TryGet()
+	second, _ := buffer.TryGet()
+	assert.Equal(t, 1, len(first.Data))
+	assert.Equal(t, 2, len(second.Data))
+	assert.Equal(t, AgentDataBufferStats{DroppedNewest: 1, DroppedBytes: 3}, buffer.Stats())
+}
+
+func TestAgentDataBufferDropOldest(t *testing.T) {
+	buffer := NewAgentDataBuffer(0, 5, OverflowDropOldest)
+
+	for i := 1; i <= 3; i++ {
+		assert.NilError(t, buffer.Add(agentDataOfSize(i), nil))
+	}
+	// Adding 3 bytes to the 3 buffered bytes evicts the oldest payload
+	assert.Equal(t, 2, buffer.Len())
+	first, _ := buffer.TryGet()
+	assert.Equal(t, 2, len(first.Data))
+	assert.Equal(t, AgentDataBufferStats{DroppedOldest: 1, DroppedBytes: 1}, buffer.Stats())
+
+	// Oversized data evicts everything else
+	assert.NilError(t, buffer.Add(agentDataOfSize(8), nil))
+	assert.Equal(t, 1, buffer.Len())
+	assert.Equal(t, AgentDataBufferStats{DroppedOldest: 2, DroppedBytes: 4}, buffer.Stats())
+}
+
+func TestAgentDataBufferBlock(t *testing.T) {
+	buffer := NewAgentDataBuffer(1, 0, OverflowBlock)
+	assert.NilError(t, buffer.Add(agentDataOfSize(1), nil))
+
+	// The writer waits for room in the buffer
+	added := make(chan error)
+	go func() {
+		added <- buffer.Add(agentDataOfSize(2), nil)
+	}()
+	select {
+	case <-added:
+		t.Fatal("Add should block while the buffer is full")
+	case <-time.After(50 * time.Millisecond):
+	}
+	buffer.TryGet()
+	assert.NilError(t, <-added)
+
+	// A blocked writer gives up once done is closed
+	done := make(chan struct{})
+	go func() {
+		added <- buffer.Add(agentDataOfSize(3), done)
+	}()
+	close(done)
+	assert.Equal(t, ErrBufferFull, <-added)
+	assert.Equal(t, AgentDataBufferStats{Rejected: 1, DroppedBytes: 3}, buffer.Stats())
+}
+
+func TestAgentDataBufferGet(t *testing.T) {
+	buffer := NewAgentDataBuffer(0, 0, OverflowBlock)
+
+	go buffer.Add(agentDataOfSize(1), nil)
+	agentData, ok := buffer.Get(nil)
+	assert.Assert(t, ok)
+	assert.Equal(t, 1, len(agentData.Data))
+
+	done := make(chan struct{})
+	close(done)
+	_, ok = buffer.Get(done)
+	assert.Assert(t, !ok)
+}
+
+func TestAgentDataBufferRequeue(t *testing.T) {
+	buffer := NewAgentDataBuffer(2, 0, OverflowReject)
+	assert.NilError(t, buffer.Add(AgentData{Data: []byte("third")}, nil))
+
+	buffer.Requeue(AgentData{Data: []byte("first")}, AgentData{Data: []byte("second")})
+	assert.Equal(t, 3, buffer.Len())
+	assert.Equal(t, 16, buffer.Size())
+	for _, expected := range []string{"first", "second", "third"} {
+		agentData, ok := buffer.Get(nil)
+		assert.Assert(t, ok)
+		assert.Equal(t, expected, string(agentData.Data))
+	}
+}
@@ -0,0 +1,113 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package extension
+
+import (
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+// AgentIDHeader identifies the agent sending a request, for functions that
+// run more than one instrumented runtime. Agents that do not send it are
+// treated as a single anonymous agent.
+const AgentIDHeader = "Elastic-Apm-Lambda-Agent-Id"
+
+// agentRegistry keeps track of the agents that sent requests to the
+// extension. Agents live as long as the execution environment, so they stay
+// registered across invocations, until they miss too many flush signals in a
+// row. Expired agents are only registered again once they signal a flush.
+type agentRegistry struct {
+	sync.Mutex
+	// agents maps the registered agents to their count of consecutive
+	// invocations without a flush signal
+	agents  map[string]int
+	expired map[string]bool
+}
+
+var registeredAgents = newAgentRegistry()
+
+func newAgentRegistry() *agentRegistry {
+	return &agentRegistry{agents: make(map[string]int), expired: make(map[string]bool)}
+}
+
+// register adds the agent to the registry, and reports whether it is new
+func (a *agentRegistry) register(agentID string, flushed bool) bool {
+	a.Lock()
+	defer a.Unlock()
+	if _, ok := a.agents[agentID]; ok {
+		return false
+	}
+	if a.expired[agentID] && !flushed {
+		return false
+	}
+	delete(a.expired, agentID)
+	a.agents[agentID] = 0
+	return true
+}
+
+// recordMissedFlushes counts the invocations in a row that the registered
+// agents did not signal a flush for, and expires the agents that missed
+// maxMissedFlushes of them. A maxMissedFlushes of zero or less never expires
+// agents.
+func (a *agentRegistry) recordMissedFlushes(pending []string, maxMissedFlushes int) {
+	a.Lock()
+	defer a.Unlock()
+	missed := make(map[string]bool, len(pending))
+	for _, agentID := range pending {
+		missed[agentID] = true
+	}
+	for agentID := range a.agents {
+		if !missed[agentID] {
+			a.agents[agentID] = 0
+			continue
+		}
+		a.agents[agentID]++
+		if maxMissedFlushes > 0 && a.agents[agentID] >= maxMissedFlushes {
+			log.Printf("No longer waiting for %s, it did not signal a flush in %d invocations", describeAgent(agentID), a.agents[agentID])
+			delete(a.agents, agentID)
+			a.expired[agentID] = true
+		}
+	}
+}
+
+// list returns the registered agents, sorted by ID
+func (a *agentRegistry) list() []string {
+	a.Lock()
+	defer a.Unlock()
+	agents := make([]string, 0, len(a.agents))
+	for agentID := range a.agents {
+		agents = append(agents, agentID)
+	}
+	sort.Strings(agents)
+	return agents
+}
+
+// agentID returns the ID of the agent that sent the request
+func agentID(r *http.Request) string {
+	return r.Header.Get(AgentIDHeader)
+}
+
+// describeAgent names the agent in logs
+func describeAgent(agentID string) string {
+	if agentID == "" {
+		return "anonymous agent"
+	}
+	return "agent " + agentID
+}
@@ -20,20 +20,185 @@ package extension
 import (
 	"bytes"
 	"compress/gzip"
+	"context"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"math/rand"
 	"net/http"
 	"sync"
+	"time"
 )
 
 var bufferPool = sync.Pool{New: func() interface{} {
 	return &bytes.Buffer{}
 }}
 
-// todo: can this be a streaming or streaming style call that keeps the
-//       connection open across invocations?
-func PostToApmServer(client *http.Client, agentData AgentData, config *extensionConfig) error {
+// PostToApmServer sends the agent data to the APM server. Failed attempts are
+// retried with jittered exponential backoff, but a retry is never started when
+// its backoff would run past the deadline of the context, and the request is
+// cancelled along with the context. Without a deadline, retries are only
+// bounded by the configured maximum. Error responses are
+// returned as an ApmServerError, and client errors are not retried.
+// Consecutive failures open a circuit breaker, which makes subsequent calls
+// fail fast until the APM server has had time to recover.
+// When several APM server endpoints are configured, the agent data is sent to
+// the next one in line if the current endpoint fails.
+// Requests are spaced out while the APM server responds with 429 or 503, and
+// ErrThrottled is returned if the agent data cannot be sent before the deadline.
+func PostToApmServer(ctx context.Context, client *http.Client, agentData AgentData, config *extensionConfig) error {
+	var err error
+	for i, destination := range apmServerEndpoints.destinations(config) {
+		if i > 0 {
+			log.Printf("Failing over to APM server %s", destination.url)
+		}
+		err = postToDestination(ctx, client, destination, agentData, config)
+		if isThrottled(err) {
+			// The endpoint is overloaded rather than failing
+			continue
+		}
+		if err == nil || !IsRetryable(err) {
+			apmServerEndpoints.markHealthy(destination.url)
+			return err
+		}
+		if ctx.Err() != nil {
+			// The send was cut short by the deadline, not by the endpoint
+			break
+		}
+		apmServerEndpoints.markFailing(destination.url)
+	}
+	return err
+}
+
+// apmServerDestination is an APM server that agent data is sent to, along
+// with its credentials, the circuit breaker guarding it and the rate limiter
+// pacing the requests sent to it. Credentials held by a credential manager
+// take precedence over the static ones, and are refreshed when rejected.
+// A destination with a signer uses AWS SigV4 instead of credentials.
+type apmServerDestination struct {
+	url         string
+	secretToken string
+	apiKey      string
+	credentials *credentialManager
+	signer      *sigV4Signer
+	breaker     *circuitBreaker
+	limiter     *rateLimiter
+}
+
+func (d *apmServerDestination) currentCredentials() ApmServerCredentials {
+	if d.credentials != nil {
+		return d.credentials.get()
+	}
+	return ApmServerCredentials{SecretToken: d.secretToken, ApiKey: d.apiKey}
+}
+
+// primaryDestination returns the preferred APM server endpoint configured
+// through ELASTIC_APM_LAMBDA_APM_SERVER
+func primaryDestination(config *extensionConfig) *apmServerDestination {
+	return apmServerEndpoints.destinations(config)[0]
+}
+
+func postToDestination(ctx context.Context, client *http.Client, destination *apmServerDestination, agentData AgentData, config *extensionConfig) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := destination.limiter.wait(ctx); err != nil {
+		return err
+	}
+	if !destination.breaker.allow(config.circuitBreakerThreshold, config.circuitBreakerCooldown) {
+		return errCircuitOpen
+	}
+
+	var err error
+	refreshed := false
+	for attempt := 0; ; attempt++ {
+		credentials := destination.currentCredentials()
+		err = sendToApmServer(ctx, client, destination, agentData)
+		destination.limiter.observe(err, config.rateLimitStep, config.rateLimitMaxInterval)
+		if isAuthError(err) && !refreshed && destination.credentials != nil {
+			// The credentials may have been rotated, retry once with new ones
+			refreshed = true
+			if destination.credentials.refresh(credentials) {
+				continue
+			}
+		}
+		if err == nil {
+			destination.breaker.recordSuccess()
+			return nil
+		}
+		if !IsRetryable(err) {
+			// The APM server is up, but refuses this data
+			destination.breaker.recordSuccess()
+			return err
+		}
+		if attempt >= config.apmServerMaxRetries {
+			break
+		}
+		delay := backoffDelay(attempt, config.apmServerRetryBackoff, config.apmServerRetryMaxBackoff)
+		if deadline, ok := ctx.Deadline(); ok && time.Now().Add(delay).After(deadline) {
+			log.Printf("Not retrying, a backoff of %v would exceed the flush deadline", delay)
+			break
+		}
+		log.Printf("Attempt %d to post to APM server %s failed, retrying in %v: %v", attempt+1, destination.url, delay, err)
+		if !sleepContext(ctx, delay) {
+			break
+		}
+		if waitErr := destination.limiter.wait(ctx); waitErr != nil {
+			log.Printf("Not retrying: %v", waitErr)
+			break
+		}
+	}
+
+	if ctx.Err() != nil {
+		// The send was cut short by the deadline, the APM server is not to
+		// blame, but a probe request is given up
+		destination.breaker.releaseProbe()
+		return err
+	}
+	if isThrottled(err) {
+		// The APM server is up but overloaded, the rate limiter slows down
+		// the requests sent to it
+		destination.breaker.releaseProbe()
+		return err
+	}
+	destination.breaker.recordFailure(config.circuitBreakerThreshold)
+	return err
+}
+
+// backoffDelay returns the delay before the given retry attempt (starting at 0).
+// The delay doubles with each attempt up to max, and half of it is randomized
+// so that retries from concurrent sandboxes do not line up.
+func backoffDelay(attempt int, base time.Duration, max time.Duration) time.Duration {
+	if base <= 0 {
+		return 0
+	}
+	delay := base
+	for i := 0; i < attempt && (max <= 0 || delay < max); i++ {
+		delay *= 2
+	}
+	if max > 0 && delay > max {
+		delay = max
+	}
+	half := delay / 2
+	return half + time.Duration(rand.Int63n(int64(delay-half)+1))
+}
+
+// sleepContext waits for the given delay, and reports false if the context
+// was cancelled in the meantime
+func sleepContext(ctx context.Context, delay time.Duration) bool {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// sendToApmServer posts the agent data to the APM server in an intake request
+// of its own, ApmServerStream sends agent data through a shared request instead
+func sendToApmServer(ctx context.Context, client *http.Client, destination *apmServerDestination, agentData AgentData) error {
 	endpointURI := "intake/v2/events"
 	encoding := agentData.ContentEncoding
 	buf := bufferPool.Get().(*bytes.Buffer)
@@ -58,16 +223,14 @@ func PostToApmServer(client *http.Client, agentData AgentData, config *extension
 		buf.Write(agentData.Data)
 	}
 
-	req, err := http.NewRequest("POST", config.apmServerUrl+endpointURI, buf)
+	req, err := http.NewRequestWithContext(ctx, "POST", destination.url+endpointURI, buf)
 	if err != nil {
 		return fmt.Errorf("failed to create a new request when posting to APM server: %v", err)
 	}
 	req.Header.Add("Content-Encoding", encoding)
 	req.Header.Add("Content-Type", "application/x-ndjson")
-	if config.apmServerApiKey != "" {
-		req.Header.Add("Authorization", "ApiKey "+config.apmServerApiKey)
-	} else if config.apmServerSecretToken != "" {
-		req.Header.Add("Authorization", "Bearer "+config.apmServerSecretToken)
+	if err := setAuthorizationHeader(req, destination, buf.Bytes()); err != nil {
+		return fmt.Errorf("failed to sign the request to the APM server: %v", err)
 	}
 
 	resp, err := client.Do(req)
@@ -84,5 +247,21 @@ func PostToApmServer(client *http.Client, agentData AgentData, config *extension
 
 	log.Printf("APM server response body: %v\n", string(body))
 	log.Printf("APM server response status code: %v\n", resp.StatusCode)
+	return checkApmServerResponse(resp, body)
+}
+
+// setAuthorizationHeader adds the credentials for the APM server to the
+// request, or signs it along with its payload when using SigV4
+func setAuthorizationHeader(req *http.Request, destination *apmServerDestination, payload []byte) error {
+	if destination.signer != nil {
+		req.Header.Del("Authorization")
+		return destination.signer.sign(req, payload)
+	}
+	credentials := destination.currentCredentials()
+	if credentials.ApiKey != "" {
+		req.Header.Add("Authorization", "ApiKey "+credentials.ApiKey)
+	} else if credentials.SecretToken != "" {
+		req.Header.Add("Authorization", "Bearer "+credentials.SecretToken)
+	}
 	return nil
 }
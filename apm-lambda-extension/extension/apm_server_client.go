@@ -0,0 +1,120 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package extension
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// NewApmServerClient returns the HTTP client shared by all requests to the
+// APM server, configured with the TLS and proxy settings of the extension
+func NewApmServerClient(config *extensionConfig) (*http.Client, error) {
+	tlsConfig, err := newTLSConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	proxy, err := newProxyFunc(config)
+	if err != nil {
+		return nil, err
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	transport.Proxy = proxy
+	return &http.Client{Transport: transport}, nil
+}
+
+func newTLSConfig(config *extensionConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if config.tlsMinVersion != "" {
+		version, ok := tlsVersions[config.tlsMinVersion]
+		if !ok {
+			return nil, fmt.Errorf("unsupported minimum TLS version %q", config.tlsMinVersion)
+		}
+		tlsConfig.MinVersion = version
+	}
+
+	if config.tlsCACert != "" {
+		caCert, err := readPEM(config.tlsCACert)
+		if err != nil {
+			return nil, fmt.Errorf("could not read CA certificate: %v", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(caCert) {
+			return nil, fmt.Errorf("no CA certificate found in %s", describePEM(config.tlsCACert))
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if config.tlsClientCert != "" || config.tlsClientKey != "" {
+		if config.tlsClientCert == "" || config.tlsClientKey == "" {
+			return nil, fmt.Errorf("both a client certificate and a client key are needed for mutual TLS")
+		}
+		certPEM, err := readPEM(config.tlsClientCert)
+		if err != nil {
+			return nil, fmt.Errorf("could not read client certificate: %v", err)
+		}
+		keyPEM, err := readPEM(config.tlsClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("could not read client key: %v", err)
+		}
+		cert, err := tls.X509KeyPair(certPEM, keyPEM)
+		if err != nil {
+			return nil, fmt.Errorf("could not load client certificate: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	if !config.tlsVerifyServerCert {
+		log.Println("WARNING: the APM server certificate is not verified, the connection is insecure")
+		tlsConfig.InsecureSkipVerify = true
+	}
+	return tlsConfig, nil
+}
+
+// readPEM returns the PEM contents of the setting, which holds either the
+// PEM contents themselves or the path of a file containing them
+func readPEM(value string) ([]byte, error) {
+	if strings.HasPrefix(strings.TrimSpace(value), "-----BEGIN") {
+		return []byte(value), nil
+	}
+	return ioutil.ReadFile(value)
+}
+
+func describePEM(value string) string {
+	if strings.HasPrefix(strings.TrimSpace(value), "-----BEGIN") {
+		return "the PEM contents"
+	}
+	return value
+}
@@ -0,0 +1,199 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package extension
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+)
+
+type testCertificate struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM []byte
+	keyPEM  []byte
+}
+
+func newTestCertificate(t *testing.T, template *x509.Certificate, parent *testCertificate) *testCertificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NilError(t, err)
+
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	parentCert, parentKey := template, key
+	if parent != nil {
+		parentCert, parentKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parentCert, &key.PublicKey, parentKey)
+	assert.NilError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.NilError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	assert.NilError(t, err)
+
+	return &testCertificate{
+		cert:    cert,
+		key:     key,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPEM:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}
+}
+
+func newTestCA(t *testing.T) *testCertificate {
+	return newTestCertificate(t, &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil)
+}
+
+func newTestServer(t *testing.T, ca *testCertificate, clientCAs *x509.CertPool) *httptest.Server {
+	serverCert := newTestCertificate(t, &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}, ca)
+	keyPair, err := tls.X509KeyPair(serverCert.certPEM, serverCert.keyPEM)
+	assert.NilError(t, err)
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	server.TLS = &tls.Config{Certificates: []tls.Certificate{keyPair}}
+	if clientCAs != nil {
+		server.TLS.ClientAuth = tls.RequireAndVerifyClientCert
+		server.TLS.ClientCAs = clientCAs
+	}
+	server.StartTLS()
+	return server
+}
+
+func TestApmServerClientCustomCA(t *testing.T) {
+	ca := newTestCA(t)
+	server := newTestServer(t, ca, nil)
+	defer server.Close()
+
+	client, err := NewApmServerClient(&extensionConfig{tlsVerifyServerCert: true})
+	assert.NilError(t, err)
+	_, err = client.Get(server.URL)
+	assert.ErrorContains(t, err, "certificate")
+
+	client, err = NewApmServerClient(&extensionConfig{tlsCACert: string(ca.certPEM), tlsVerifyServerCert: true})
+	assert.NilError(t, err)
+	resp, err := client.Get(server.URL)
+	assert.NilError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, resp.StatusCode, http.StatusAccepted)
+}
+
+func TestApmServerClientCAFromFile(t *testing.T) {
+	ca := newTestCA(t)
+	server := newTestServer(t, ca, nil)
+	defer server.Close()
+
+	dir, _ := ioutil.TempDir("", "tls")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "ca.pem")
+	assert.NilError(t, ioutil.WriteFile(path, ca.certPEM, 0600))
+
+	client, err := NewApmServerClient(&extensionConfig{tlsCACert: path, tlsVerifyServerCert: true})
+	assert.NilError(t, err)
+	resp, err := client.Get(server.URL)
+	assert.NilError(t, err)
+	resp.Body.Close()
+}
+
+func TestApmServerClientMutualTLS(t *testing.T) {
+	ca := newTestCA(t)
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(ca.cert)
+	server := newTestServer(t, ca, clientCAs)
+	defer server.Close()
+
+	clientCert := newTestCertificate(t, &x509.Certificate{
+		SerialNumber: big.NewInt(3),
+		Subject:      pkix.Name{CommonName: "extension"},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}, ca)
+
+	client, err := NewApmServerClient(&extensionConfig{tlsCACert: string(ca.certPEM), tlsVerifyServerCert: true})
+	assert.NilError(t, err)
+	_, err = client.Get(server.URL)
+	assert.Assert(t, err != nil)
+
+	client, err = NewApmServerClient(&extensionConfig{
+		tlsCACert:           string(ca.certPEM),
+		tlsClientCert:       string(clientCert.certPEM),
+		tlsClientKey:        string(clientCert.keyPEM),
+		tlsVerifyServerCert: true,
+	})
+	assert.NilError(t, err)
+	resp, err := client.Get(server.URL)
+	assert.NilError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, resp.StatusCode, http.StatusAccepted)
+}
+
+func TestApmServerClientInsecure(t *testing.T) {
+	server := newTestServer(t, newTestCA(t), nil)
+	defer server.Close()
+
+	client, err := NewApmServerClient(&extensionConfig{tlsVerifyServerCert: false})
+	assert.NilError(t, err)
+	resp, err := client.Get(server.URL)
+	assert.NilError(t, err)
+	resp.Body.Close()
+}
+
+func TestApmServerClientInvalidConfig(t *testing.T) {
+	_, err := NewApmServerClient(&extensionConfig{tlsMinVersion: "1.4", tlsVerifyServerCert: true})
+	assert.ErrorContains(t, err, "unsupported minimum TLS version")
+
+	_, err = NewApmServerClient(&extensionConfig{tlsCACert: "/does/not/exist.pem", tlsVerifyServerCert: true})
+	assert.ErrorContains(t, err, "could not read CA certificate")
+
+	_, err = NewApmServerClient(&extensionConfig{tlsClientCert: "/some/cert.pem", tlsVerifyServerCert: true})
+	assert.ErrorContains(t, err, "both a client certificate and a client key")
+}
+
+func TestApmServerClientMinVersion(t *testing.T) {
+	client, err := NewApmServerClient(&extensionConfig{tlsMinVersion: "1.3", tlsVerifyServerCert: true})
+	assert.NilError(t, err)
+	assert.Equal(t, client.Transport.(*http.Transport).TLSClientConfig.MinVersion, uint16(tls.VersionTLS13))
+}
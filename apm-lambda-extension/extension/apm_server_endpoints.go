@@ -0,0 +1,127 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package extension
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// apmServerEndpoints keeps track of the health of the APM server endpoints
+// listed in ELASTIC_APM_LAMBDA_APM_SERVER. As it lives as long as the
+// extension process, an endpoint found to be failing is skipped on the
+// following invocations too, until its failover cooldown has elapsed.
+var apmServerEndpoints = newEndpointPool()
+
+type endpointPool struct {
+	sync.Mutex
+	breakers map[string]*circuitBreaker
+	limiters map[string]*rateLimiter
+	failedAt map[string]time.Time
+	now      func() time.Time
+}
+
+func newEndpointPool() *endpointPool {
+	return &endpointPool{
+		breakers: make(map[string]*circuitBreaker),
+		limiters: make(map[string]*rateLimiter),
+		failedAt: make(map[string]time.Time),
+		now:      time.Now,
+	}
+}
+
+// parseApmServerUrls splits the comma separated list of APM server endpoints,
+// adding a trailing slash to each of them if missing
+func parseApmServerUrls(value string) []string {
+	var urls []string
+	for _, url := range strings.Split(value, ",") {
+		url = strings.TrimSpace(url)
+		if url == "" {
+			continue
+		}
+		if !strings.HasSuffix(url, "/") {
+			url += "/"
+		}
+		urls = append(urls, url)
+	}
+	return urls
+}
+
+// destinations returns the APM server endpoints in the order they should be
+// tried: the healthy ones in their configured order, followed by the failing
+// ones, least recently failed first, as a last resort.
+func (p *endpointPool) destinations(config *extensionConfig) []*apmServerDestination {
+	urls := config.apmServerUrls
+	if len(urls) == 0 {
+		urls = []string{config.apmServerUrl}
+	}
+
+	p.Lock()
+	defer p.Unlock()
+
+	now := p.now()
+	var healthy, failing []*apmServerDestination
+	for _, url := range urls {
+		breaker, ok := p.breakers[url]
+		if !ok {
+			breaker = newCircuitBreaker()
+			p.breakers[url] = breaker
+		}
+		limiter, ok := p.limiters[url]
+		if !ok {
+			limiter = newRateLimiter()
+			p.limiters[url] = limiter
+		}
+		destination := &apmServerDestination{
+			url:         url,
+			secretToken: config.apmServerSecretToken,
+			apiKey:      config.apmServerApiKey,
+			credentials: config.credentials,
+			signer:      config.sigV4Signer,
+			breaker:     breaker,
+			limiter:     limiter,
+		}
+		failedAt, failed := p.failedAt[url]
+		if failed && now.Sub(failedAt) < config.failoverCooldown {
+			failing = append(failing, destination)
+		} else {
+			healthy = append(healthy, destination)
+		}
+	}
+	sort.SliceStable(failing, func(i, j int) bool {
+		return p.failedAt[failing[i].url].Before(p.failedAt[failing[j].url])
+	})
+	return append(healthy, failing...)
+}
+
+// markHealthy records that the endpoint responded
+func (p *endpointPool) markHealthy(url string) {
+	p.Lock()
+	defer p.Unlock()
+	delete(p.failedAt, url)
+}
+
+// markFailing records that the endpoint could not be reached or failed to
+// handle a request, so that other endpoints are preferred over it
+func (p *endpointPool) markFailing(url string) {
+	p.Lock()
+	defer p.Unlock()
+	p.failedAt[url] = p.now()
+}
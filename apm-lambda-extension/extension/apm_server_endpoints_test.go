@@ -0,0 +1,163 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package extension
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+)
+
+func TestParseApmServerUrls(t *testing.T) {
+	assert.DeepEqual(t, []string{"https://a.example.com/", "https://b.example.com/"},
+		parseApmServerUrls(" https://a.example.com, https://b.example.com/ ,"))
+	assert.Equal(t, 0, len(parseApmServerUrls("")))
+}
+
+func TestEndpointPoolOrder(t *testing.T) {
+	now := time.Now()
+	pool := newEndpointPool()
+	pool.now = func() time.Time { return now }
+	config := extensionConfig{
+		apmServerUrls:    []string{"a/", "b/", "c/"},
+		failoverCooldown: time.Minute,
+	}
+	urls := func() []string {
+		var urls []string
+		for _, destination := range pool.destinations(&config) {
+			urls = append(urls, destination.url)
+		}
+		return urls
+	}
+
+	assert.DeepEqual(t, []string{"a/", "b/", "c/"}, urls())
+
+	pool.markFailing("b/")
+	now = now.Add(time.Second)
+	pool.markFailing("a/")
+	assert.DeepEqual(t, []string{"c/", "b/", "a/"}, urls())
+
+	// Failing endpoints are preferred again once the cooldown has elapsed
+	now = now.Add(time.Minute - time.Second)
+	assert.DeepEqual(t, []string{"b/", "c/", "a/"}, urls())
+
+	pool.markHealthy("a/")
+	assert.DeepEqual(t, []string{"a/", "b/", "c/"}, urls())
+}
+
+func TestPostToApmServerFailover(t *testing.T) {
+	defer func() { apmServerEndpoints = newEndpointPool() }()
+	agentData := AgentData{Data: []byte("A long time ago in a galaxy far, far away..."), ContentEncoding: ""}
+
+	var primaryRequests, secondaryRequests int32
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&primaryRequests, 1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer primary.Close()
+	secondary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&secondaryRequests, 1)
+		ioutil.ReadAll(r.Body)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer secondary.Close()
+
+	config := extensionConfig{
+		apmServerUrl:     primary.URL + "/",
+		apmServerUrls:    []string{primary.URL + "/", secondary.URL + "/"},
+		failoverCooldown: time.Minute,
+	}
+
+	err := PostToApmServer(context.Background(), primary.Client(), agentData, &config)
+	assert.NilError(t, err)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&primaryRequests))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&secondaryRequests))
+
+	// The failing endpoint is skipped on the next send
+	err = PostToApmServer(context.Background(), primary.Client(), agentData, &config)
+	assert.NilError(t, err)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&primaryRequests))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&secondaryRequests))
+}
+
+func TestPostToApmServerThrottlingIsNotAFailure(t *testing.T) {
+	defer func() { apmServerEndpoints = newEndpointPool() }()
+	agentData := AgentData{Data: []byte("A long time ago in a galaxy far, far away..."), ContentEncoding: ""}
+
+	var primaryRequests, secondaryRequests int32
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&primaryRequests, 1)
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer primary.Close()
+	secondary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&secondaryRequests, 1)
+		ioutil.ReadAll(r.Body)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer secondary.Close()
+
+	config := extensionConfig{
+		apmServerUrl:            primary.URL + "/",
+		apmServerUrls:           []string{primary.URL + "/", secondary.URL + "/"},
+		failoverCooldown:        time.Minute,
+		circuitBreakerThreshold: 1,
+		circuitBreakerCooldown:  time.Minute,
+	}
+
+	for i := 1; i <= 2; i++ {
+		err := PostToApmServer(context.Background(), primary.Client(), agentData, &config)
+		assert.NilError(t, err)
+		assert.Equal(t, int32(i), atomic.LoadInt32(&primaryRequests))
+		assert.Equal(t, int32(i), atomic.LoadInt32(&secondaryRequests))
+	}
+
+	// The throttling endpoint stays first in line, with its breaker closed
+	destinations := apmServerEndpoints.destinations(&config)
+	assert.Equal(t, primary.URL+"/", destinations[0].url)
+	assert.Equal(t, circuitClosed, destinations[0].breaker.currentState())
+}
+
+func TestInfoProxyFailover(t *testing.T) {
+	defer func() { apmServerEndpoints = newEndpointPool() }()
+
+	// The first endpoint cannot be reached
+	unreachable := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	unreachable.Close()
+	apmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"version": "8.0.0"}`))
+	}))
+	defer apmServer.Close()
+
+	config := extensionConfig{
+		apmServerUrls:    []string{unreachable.URL + "/", apmServer.URL + "/"},
+		failoverCooldown: time.Minute,
+	}
+
+	recorder := httptest.NewRecorder()
+	handleInfoRequest(apmServer.Client(), &config)(recorder, httptest.NewRequest("GET", "/", nil))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, `{"version": "8.0.0"}`, recorder.Body.String())
+	assert.Equal(t, apmServer.URL+"/", apmServerEndpoints.destinations(&config)[0].url)
+}
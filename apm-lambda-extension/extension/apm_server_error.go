@@ -0,0 +1,148 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package extension
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// IntakeEventError describes an event rejected by the APM server
+type IntakeEventError struct {
+	Message  string `json:"message"`
+	Document string `json:"document,omitempty"`
+}
+
+// intakeResponse is the body of an intake v2 error response
+type intakeResponse struct {
+	Accepted int                `json:"accepted"`
+	Errors   []IntakeEventError `json:"errors"`
+}
+
+// ApmServerError is returned when the APM server responds to an intake
+// request with an error status code
+type ApmServerError struct {
+	StatusCode int
+	Accepted   int
+	Errors     []IntakeEventError
+	Body       string
+	RetryAfter time.Duration
+}
+
+func (e *ApmServerError) Error() string {
+	msg := fmt.Sprintf("APM server responded with status code %d", e.StatusCode)
+	if len(e.Errors) > 0 {
+		msg += fmt.Sprintf(", %d events accepted, %d rejected: %s", e.Accepted, len(e.Errors), e.Errors[0].Message)
+	} else if e.Body != "" {
+		msg += ": " + e.Body
+	}
+	if e.RetryAfter > 0 {
+		msg += fmt.Sprintf(", retry after %v", e.RetryAfter)
+	}
+	return msg
+}
+
+// Retryable reports whether sending the same data again may succeed. Server
+// errors are transient, while client errors would fail in the same way again.
+func (e *ApmServerError) Retryable() bool {
+	return e.StatusCode >= 500 || e.StatusCode == http.StatusTooManyRequests || e.StatusCode == http.StatusRequestTimeout
+}
+
+// IsRetryable reports whether agent data that failed to send with the given
+// error should be sent again. Errors that did not come with a response from
+// the APM server are always retryable.
+func IsRetryable(err error) bool {
+	var apmServerErr *ApmServerError
+	if errors.As(err, &apmServerErr) {
+		return apmServerErr.Retryable()
+	}
+	return true
+}
+
+// IntakeStats summarizes the responses to intake requests sent to the APM
+// server since the extension started
+type IntakeStats struct {
+	Requests       int
+	Succeeded      int
+	ClientErrors   int
+	ServerErrors   int
+	AcceptedEvents int
+	RejectedEvents int
+}
+
+var (
+	intakeStatsMutex sync.Mutex
+	intakeStats      IntakeStats
+)
+
+// GetIntakeStats returns the summary of the intake responses received so far
+func GetIntakeStats() IntakeStats {
+	intakeStatsMutex.Lock()
+	defer intakeStatsMutex.Unlock()
+	return intakeStats
+}
+
+func (s IntakeStats) String() string {
+	return fmt.Sprintf("requests: %d, succeeded: %d, client errors: %d, server errors: %d, events accepted: %d, events rejected: %d",
+		s.Requests, s.Succeeded, s.ClientErrors, s.ServerErrors, s.AcceptedEvents, s.RejectedEvents)
+}
+
+// checkApmServerResponse records the outcome of an intake request and turns
+// an error response into an ApmServerError
+func checkApmServerResponse(resp *http.Response, body []byte) error {
+	statusCode := resp.StatusCode
+	var parsed intakeResponse
+	if len(body) > 0 {
+		if err := json.Unmarshal(body, &parsed); err != nil {
+			log.Printf("Could not parse APM server response: %v", err)
+		}
+	}
+
+	intakeStatsMutex.Lock()
+	intakeStats.Requests++
+	intakeStats.AcceptedEvents += parsed.Accepted
+	intakeStats.RejectedEvents += len(parsed.Errors)
+	switch {
+	case statusCode >= 500:
+		intakeStats.ServerErrors++
+	case statusCode >= 400:
+		intakeStats.ClientErrors++
+	default:
+		intakeStats.Succeeded++
+	}
+	intakeStatsMutex.Unlock()
+
+	if statusCode < 400 {
+		return nil
+	}
+	apmServerErr := &ApmServerError{
+		StatusCode: statusCode,
+		Accepted:   parsed.Accepted,
+		Errors:     parsed.Errors,
+		RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()),
+	}
+	if len(parsed.Errors) == 0 {
+		apmServerErr.Body = string(body)
+	}
+	return apmServerErr
+}
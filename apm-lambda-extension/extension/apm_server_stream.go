@@ -0,0 +1,271 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package extension
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sync"
+)
+
+var errStreamAborted = errors.New("stream to the APM server was aborted")
+
+// ApmServerStream sends agent data to the APM server over a single, chunked
+// intake request rather than one request per agent payload. Each payload is
+// written into the open request as it arrives. As the intake API only accepts
+// metadata at the start of a request, a payload with different metadata ends
+// the current request and starts a new one.
+//
+// The stream must be closed before the sandbox is frozen at the end of each
+// invocation. Payloads written to a stream that breaks are sent again with
+// PostToApmServer, so the APM server may receive some events twice.
+type ApmServerStream struct {
+	sync.Mutex
+	client     *http.Client
+	config     *extensionConfig
+	dataBuffer *AgentDataBuffer
+
+	destination *apmServerDestination
+	pipeWriter  *io.PipeWriter
+	gzipWriter  *gzip.Writer
+	cancel      context.CancelFunc
+	result      chan error
+	metadata    []byte
+	pending     []AgentData
+}
+
+// NewApmServerStream returns a stream to the APM server, which is opened
+// lazily when the first agent data is sent. Agent data held back by the APM
+// server rate limits is deferred to the spool, or else to the given buffer.
+func NewApmServerStream(client *http.Client, dataBuffer *AgentDataBuffer, config *extensionConfig) *ApmServerStream {
+	return &ApmServerStream{client: client, config: config, dataBuffer: dataBuffer}
+}
+
+// Send writes the agent data into the stream, opening a new request if needed.
+// Agent data that cannot be streamed is sent with PostToApmServer instead.
+// ErrThrottled is returned if agent data was deferred because the APM server
+// is throttling requests.
+func (s *ApmServerStream) Send(ctx context.Context, agentData AgentData) error {
+	data, err := decompressAgentData(agentData)
+	if err != nil {
+		log.Printf("Could not stream agent data, sending it separately: %v", err)
+		return s.sendSeparately(ctx, []AgentData{agentData})
+	}
+	metadata, events := splitMetadata(data)
+	if metadata == nil {
+		log.Println("Agent data has no metadata, sending it separately")
+		return s.sendSeparately(ctx, []AgentData{agentData})
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	if s.isOpen() && !bytes.Equal(metadata, s.metadata) {
+		if err := s.closeLocked(ctx); err != nil {
+			deferAgentData([]AgentData{agentData}, s.dataBuffer, err)
+			return err
+		}
+	}
+	if !s.isOpen() {
+		if err := s.open(ctx, metadata); err != nil {
+			log.Printf("Could not open stream to APM server, sending agent data separately: %v", err)
+			return s.sendSeparately(ctx, []AgentData{agentData})
+		}
+	}
+	s.pending = append(s.pending, agentData)
+	if err := s.write(events); err != nil {
+		log.Printf("Stream to APM server broke, sending agent data separately: %v", err)
+		pending := s.pending
+		s.fail()
+		return s.sendSeparately(ctx, pending)
+	}
+	return nil
+}
+
+// Close ends the streaming request, if one is open, and waits for the
+// response of the APM server until the context is done
+func (s *ApmServerStream) Close(ctx context.Context) {
+	s.Lock()
+	defer s.Unlock()
+	if err := s.closeLocked(ctx); err != nil {
+		log.Printf("Deferred agent data of the stream to the next invocation: %v", err)
+	}
+}
+
+func (s *ApmServerStream) isOpen() bool {
+	return s.pipeWriter != nil
+}
+
+func (s *ApmServerStream) open(ctx context.Context, metadata []byte) error {
+	destination := primaryDestination(s.config)
+	if err := destination.limiter.wait(ctx); err != nil {
+		return err
+	}
+	if !destination.breaker.allow(s.config.circuitBreakerThreshold, s.config.circuitBreakerCooldown) {
+		return errCircuitOpen
+	}
+
+	pipeReader, pipeWriter := io.Pipe()
+	// The request is cancelled when the invocation is over, if not closed before
+	ctx, cancel := context.WithCancel(ctx)
+	req, err := http.NewRequestWithContext(ctx, "POST", destination.url+"intake/v2/events", pipeReader)
+	if err != nil {
+		cancel()
+		destination.breaker.recordFailure(s.config.circuitBreakerThreshold)
+		return fmt.Errorf("failed to create a new request when streaming to APM server: %v", err)
+	}
+	req.Header.Add("Content-Encoding", "gzip")
+	req.Header.Add("Content-Type", "application/x-ndjson")
+	// The payload of the stream is not known upfront, so it cannot be signed
+	// with SigV4, which ProcessEnv rules out
+	setAuthorizationHeader(req, destination, nil)
+
+	result := make(chan error, 1)
+	go func() {
+		resp, err := s.client.Do(req)
+		if err != nil {
+			pipeReader.CloseWithError(err)
+			result <- fmt.Errorf("failed to stream to APM server: %v", err)
+			return
+		}
+		// Unblock any writer, the APM server does not read the request anymore
+		pipeReader.Close()
+
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			result <- fmt.Errorf("failed to read the response body after streaming to the APM server")
+			return
+		}
+		log.Printf("APM server stream response body: %v\n", string(body))
+		log.Printf("APM server stream response status code: %v\n", resp.StatusCode)
+		result <- checkApmServerResponse(resp, body)
+	}()
+
+	gzipWriter, _ := gzip.NewWriterLevel(pipeWriter, gzip.BestSpeed)
+	s.destination = destination
+	s.pipeWriter = pipeWriter
+	s.gzipWriter = gzipWriter
+	s.cancel = cancel
+	s.result = result
+	s.metadata = metadata
+	s.pending = nil
+
+	if err := s.write(metadata); err != nil {
+		s.fail()
+		return err
+	}
+	log.Println("Opened stream to APM server")
+	return nil
+}
+
+// write sends ndjson lines through the stream and flushes them, so that
+// they are sent to the APM server right away
+func (s *ApmServerStream) write(lines []byte) error {
+	if len(lines) == 0 {
+		return nil
+	}
+	if _, err := s.gzipWriter.Write(lines); err != nil {
+		return err
+	}
+	if lines[len(lines)-1] != '\n' {
+		if _, err := s.gzipWriter.Write([]byte("\n")); err != nil {
+			return err
+		}
+	}
+	return s.gzipWriter.Flush()
+}
+
+func (s *ApmServerStream) closeLocked(ctx context.Context) error {
+	if !s.isOpen() {
+		return nil
+	}
+	pending := s.pending
+	destination := s.destination
+
+	err := s.gzipWriter.Close()
+	if err == nil {
+		err = s.pipeWriter.Close()
+	}
+	if err == nil {
+		err = s.waitForResult(ctx)
+	}
+	s.abort()
+	destination.limiter.observe(err, s.config.rateLimitStep, s.config.rateLimitMaxInterval)
+
+	if err != nil && IsRetryable(err) {
+		if isThrottled(err) || ctx.Err() != nil {
+			destination.breaker.releaseProbe()
+		} else {
+			destination.breaker.recordFailure(s.config.circuitBreakerThreshold)
+			apmServerEndpoints.markFailing(destination.url)
+		}
+		log.Printf("Stream to APM server failed, sending %d payloads separately: %v", len(pending), err)
+		return s.sendSeparately(ctx, pending)
+	}
+	destination.breaker.recordSuccess()
+	apmServerEndpoints.markHealthy(destination.url)
+	if err != nil {
+		log.Printf("APM server rejected the stream of %d payloads, dropping them: %v", len(pending), err)
+		return nil
+	}
+	log.Printf("Closed stream to APM server after sending %d payloads", len(pending))
+	return nil
+}
+
+func (s *ApmServerStream) waitForResult(ctx context.Context) error {
+	select {
+	case err := <-s.result:
+		return err
+	case <-ctx.Done():
+		return fmt.Errorf("timed out waiting for the APM server to respond to the stream: %v", ctx.Err())
+	}
+}
+
+// fail aborts a stream that broke while writing to it, counting it as a
+// failed send, so that a stream opened as the circuit breaker probe does not
+// leave the breaker half-open
+func (s *ApmServerStream) fail() {
+	s.destination.breaker.recordFailure(s.config.circuitBreakerThreshold)
+	apmServerEndpoints.markFailing(s.destination.url)
+	s.abort()
+}
+
+// abort cancels the streaming request and resets the stream state
+func (s *ApmServerStream) abort() {
+	s.pipeWriter.CloseWithError(errStreamAborted)
+	s.cancel()
+	s.destination = nil
+	s.pipeWriter = nil
+	s.gzipWriter = nil
+	s.cancel = nil
+	s.result = nil
+	s.metadata = nil
+	s.pending = nil
+}
+
+func (s *ApmServerStream) sendSeparately(ctx context.Context, agentData []AgentData) error {
+	return sendPayloads(ctx, s.client, agentData, s.dataBuffer, s.config)
+}
@@ -0,0 +1,163 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package extension
+
+import (
+	"compress/gzip"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+)
+
+// newStreamTestServer returns an APM server that records the uncompressed body of every request
+func newStreamTestServer(handler func(requestIndex int, w http.ResponseWriter) bool) (*httptest.Server, func() []string) {
+	var mu sync.Mutex
+	var bodies []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		index := len(bodies)
+		bodies = append(bodies, "")
+		mu.Unlock()
+		if handler != nil && !handler(index, w) {
+			return
+		}
+		reader, _ := gzip.NewReader(r.Body)
+		body, _ := ioutil.ReadAll(reader)
+		mu.Lock()
+		bodies[index] = string(body)
+		mu.Unlock()
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	return server, func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), bodies...)
+	}
+}
+
+func TestApmServerStreamSharesOneRequest(t *testing.T) {
+	apmServer, bodies := newStreamTestServer(nil)
+	defer apmServer.Close()
+	config := extensionConfig{apmServerUrl: apmServer.URL + "/"}
+
+	stream := NewApmServerStream(apmServer.Client(), NewAgentDataBuffer(100, 0, OverflowBlock), &config)
+	stream.Send(context.Background(), AgentData{Data: []byte(`{"metadata":{"service":{"name":"foo"}}}` + "\n" + `{"transaction":{"id":"1"}}` + "\n")})
+	stream.Send(context.Background(), AgentData{Data: []byte(`{"metadata":{"service":{"name":"foo"}}}` + "\n" + `{"transaction":{"id":"2"}}`)})
+	stream.Close(context.Background())
+
+	assert.DeepEqual(t, []string{
+		`{"metadata":{"service":{"name":"foo"}}}` + "\n" + `{"transaction":{"id":"1"}}` + "\n" + `{"transaction":{"id":"2"}}` + "\n",
+	}, bodies())
+}
+
+func TestApmServerStreamStartsNewRequestForNewMetadata(t *testing.T) {
+	apmServer, bodies := newStreamTestServer(nil)
+	defer apmServer.Close()
+	config := extensionConfig{apmServerUrl: apmServer.URL + "/"}
+
+	stream := NewApmServerStream(apmServer.Client(), NewAgentDataBuffer(100, 0, OverflowBlock), &config)
+	stream.Send(context.Background(), AgentData{Data: []byte(`{"metadata":{"service":{"name":"foo"}}}` + "\n" + `{"span":{"id":"1"}}` + "\n")})
+	stream.Send(context.Background(), AgentData{Data: []byte(`{"metadata":{"service":{"name":"bar"}}}` + "\n" + `{"span":{"id":"2"}}` + "\n")})
+	stream.Close(context.Background())
+
+	assert.DeepEqual(t, []string{
+		`{"metadata":{"service":{"name":"foo"}}}` + "\n" + `{"span":{"id":"1"}}` + "\n",
+		`{"metadata":{"service":{"name":"bar"}}}` + "\n" + `{"span":{"id":"2"}}` + "\n",
+	}, bodies())
+}
+
+func TestApmServerStreamFallsBackWhenBroken(t *testing.T) {
+	// Create apm server that drops the streaming request
+	apmServer, bodies := newStreamTestServer(func(requestIndex int, w http.ResponseWriter) bool {
+		if requestIndex == 0 {
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			conn.Close()
+			return false
+		}
+		return true
+	})
+	defer apmServer.Close()
+	config := extensionConfig{apmServerUrl: apmServer.URL + "/"}
+
+	payload := `{"metadata":{"service":{"name":"foo"}}}` + "\n" + `{"error":{"id":"1"}}` + "\n"
+	stream := NewApmServerStream(apmServer.Client(), NewAgentDataBuffer(100, 0, OverflowBlock), &config)
+	stream.Send(context.Background(), AgentData{Data: []byte(payload)})
+	stream.Close(context.Background())
+
+	received := bodies()
+	assert.Equal(t, 2, len(received))
+	assert.Equal(t, payload, received[1])
+}
+
+func TestApmServerStreamReopensCircuitBreakerWhenProbeBreaks(t *testing.T) {
+	defer func() { apmServerEndpoints = newEndpointPool() }()
+
+	// Create apm server that refuses connections
+	apmServer := httptest.NewServer(nil)
+	apmServer.Close()
+	config := extensionConfig{
+		apmServerUrl:            apmServer.URL + "/",
+		circuitBreakerThreshold: 1,
+		circuitBreakerCooldown:  time.Millisecond,
+	}
+
+	// Let the cooldown elapse, the stream is the probe request
+	breaker := primaryDestination(&config).breaker
+	breaker.recordFailure(config.circuitBreakerThreshold)
+	time.Sleep(10 * time.Millisecond)
+
+	dataBuffer := NewAgentDataBuffer(100, 0, OverflowBlock)
+	stream := NewApmServerStream(apmServer.Client(), dataBuffer, &config)
+	stream.Send(context.Background(), AgentData{Data: []byte(`{"metadata":{"service":{"name":"foo"}}}` + "\n" + `{"error":{"id":"1"}}` + "\n")})
+	assert.Equal(t, circuitOpen, breaker.currentState())
+}
+
+func TestSplitMetadata(t *testing.T) {
+	metadata, events := splitMetadata([]byte(`{"metadata":{}}` + "\n" + `{"span":{}}` + "\n"))
+	assert.Equal(t, `{"metadata":{}}`, string(metadata))
+	assert.Equal(t, `{"span":{}}`+"\n", string(events))
+
+	metadata, events = splitMetadata([]byte(`{"span":{}}`))
+	assert.Assert(t, metadata == nil)
+	assert.Equal(t, `{"span":{}}`, string(events))
+
+	metadata, events = splitMetadata([]byte(`{"metadata":{}}`))
+	assert.Equal(t, `{"metadata":{}}`, string(metadata))
+	assert.Equal(t, 0, len(events))
+}
+
+func TestDecompressAgentData(t *testing.T) {
+	var compressed strings.Builder
+	gw := gzip.NewWriter(&compressed)
+	gw.Write([]byte("foo"))
+	gw.Close()
+
+	data, err := decompressAgentData(AgentData{Data: []byte(compressed.String()), ContentEncoding: "gzip"})
+	assert.NilError(t, err)
+	assert.Equal(t, "foo", string(data))
+
+	_, err = decompressAgentData(AgentData{Data: []byte("foo"), ContentEncoding: "br"})
+	assert.Assert(t, err != nil)
+}
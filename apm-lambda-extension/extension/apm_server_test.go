@@ -19,11 +19,14 @@ package extension
 
 import (
 	"compress/gzip"
+	"context"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"gotest.tools/assert"
 )
@@ -57,7 +60,7 @@ func TestPostToApmServerDataCompressed(t *testing.T) {
 		apmServerUrl: apmServer.URL + "/",
 	}
 
-	err := PostToApmServer(apmServer.Client(), agentData, &config)
+	err := PostToApmServer(context.Background(), apmServer.Client(), agentData, &config)
 	assert.Equal(t, nil, err)
 }
 
@@ -90,10 +93,179 @@ func TestPostToApmServerDataNotCompressed(t *testing.T) {
 		apmServerUrl: apmServer.URL + "/",
 	}
 
-	err := PostToApmServer(apmServer.Client(), agentData, &config)
+	err := PostToApmServer(context.Background(), apmServer.Client(), agentData, &config)
 	assert.Equal(t, nil, err)
 }
 
+func TestPostToApmServerRetriesFailedAttempts(t *testing.T) {
+	agentData := AgentData{Data: []byte("A long time ago in a galaxy far, far away..."), ContentEncoding: ""}
+
+	// Create apm server that drops the connection on the first two requests
+	var requests int32
+	apmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) <= 2 {
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			conn.Close()
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer apmServer.Close()
+
+	config := extensionConfig{
+		apmServerUrl:          apmServer.URL + "/",
+		apmServerMaxRetries:   3,
+		apmServerRetryBackoff: time.Millisecond,
+	}
+
+	err := PostToApmServer(context.Background(), apmServer.Client(), agentData, &config)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&requests))
+}
+
+func TestPostToApmServerStopsRetryingAtDeadline(t *testing.T) {
+	agentData := AgentData{Data: []byte("A long time ago in a galaxy far, far away..."), ContentEncoding: ""}
+
+	// Create apm server that always drops the connection
+	var requests int32
+	apmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		conn, _, _ := w.(http.Hijacker).Hijack()
+		conn.Close()
+	}))
+	defer apmServer.Close()
+
+	config := extensionConfig{
+		apmServerUrl:          apmServer.URL + "/",
+		apmServerMaxRetries:   5,
+		apmServerRetryBackoff: time.Second,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	err := PostToApmServer(ctx, apmServer.Client(), agentData, &config)
+	assert.Assert(t, err != nil)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&requests))
+}
+
+func TestPostToApmServerCircuitBreaker(t *testing.T) {
+	defer func() { apmServerEndpoints = newEndpointPool() }()
+	agentData := AgentData{Data: []byte("A long time ago in a galaxy far, far away..."), ContentEncoding: ""}
+
+	// Create apm server that always drops the connection
+	var requests int32
+	apmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		conn, _, _ := w.(http.Hijacker).Hijack()
+		conn.Close()
+	}))
+	defer apmServer.Close()
+
+	config := extensionConfig{
+		apmServerUrl:            apmServer.URL + "/",
+		circuitBreakerThreshold: 2,
+		circuitBreakerCooldown:  time.Minute,
+	}
+
+	for i := 0; i < 2; i++ {
+		err := PostToApmServer(context.Background(), apmServer.Client(), agentData, &config)
+		assert.Assert(t, err != nil && err != errCircuitOpen)
+	}
+	err := PostToApmServer(context.Background(), apmServer.Client(), agentData, &config)
+	assert.Equal(t, errCircuitOpen, err)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&requests))
+}
+
+func TestPostToApmServerErrorResponse(t *testing.T) {
+	agentData := AgentData{Data: []byte("A long time ago in a galaxy far, far away..."), ContentEncoding: ""}
+
+	// Create apm server that rejects some of the events
+	var requests int32
+	apmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"accepted": 2, "errors": [{"message": "decode error", "document": "{\"span\": {}}"}]}`))
+	}))
+	defer apmServer.Close()
+
+	config := extensionConfig{
+		apmServerUrl:          apmServer.URL + "/",
+		apmServerMaxRetries:   3,
+		apmServerRetryBackoff: time.Millisecond,
+	}
+
+	statsBefore := GetIntakeStats()
+	err := PostToApmServer(context.Background(), apmServer.Client(), agentData, &config)
+	apmServerErr, ok := err.(*ApmServerError)
+	assert.Assert(t, ok)
+	assert.Equal(t, http.StatusBadRequest, apmServerErr.StatusCode)
+	assert.Equal(t, 2, apmServerErr.Accepted)
+	assert.DeepEqual(t, []IntakeEventError{{Message: "decode error", Document: `{"span": {}}`}}, apmServerErr.Errors)
+	assert.Assert(t, !IsRetryable(err))
+
+	// Client errors are not retried
+	assert.Equal(t, int32(1), atomic.LoadInt32(&requests))
+
+	statsAfter := GetIntakeStats()
+	assert.Equal(t, 1, statsAfter.ClientErrors-statsBefore.ClientErrors)
+	assert.Equal(t, 2, statsAfter.AcceptedEvents-statsBefore.AcceptedEvents)
+	assert.Equal(t, 1, statsAfter.RejectedEvents-statsBefore.RejectedEvents)
+}
+
+func TestPostToApmServerRetriesServerErrors(t *testing.T) {
+	agentData := AgentData{Data: []byte("A long time ago in a galaxy far, far away..."), ContentEncoding: ""}
+
+	// Create apm server that is unavailable for the first request
+	var requests int32
+	apmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte(`{"errors": [{"message": "queue is full"}]}`))
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer apmServer.Close()
+
+	config := extensionConfig{
+		apmServerUrl:          apmServer.URL + "/",
+		apmServerMaxRetries:   3,
+		apmServerRetryBackoff: time.Millisecond,
+	}
+
+	err := PostToApmServer(context.Background(), apmServer.Client(), agentData, &config)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&requests))
+}
+
+func TestApmServerErrorRetryable(t *testing.T) {
+	for statusCode, retryable := range map[int]bool{
+		http.StatusBadRequest:            false,
+		http.StatusUnauthorized:          false,
+		http.StatusForbidden:             false,
+		http.StatusRequestEntityTooLarge: false,
+		http.StatusTooManyRequests:       true,
+		http.StatusInternalServerError:   true,
+		http.StatusServiceUnavailable:    true,
+	} {
+		err := &ApmServerError{StatusCode: statusCode}
+		assert.Equal(t, retryable, IsRetryable(err), "status code %d", statusCode)
+	}
+	assert.Assert(t, IsRetryable(errCircuitOpen))
+}
+
+func TestBackoffDelay(t *testing.T) {
+	for attempt := 0; attempt < 10; attempt++ {
+		delay := backoffDelay(attempt, 100*time.Millisecond, time.Second)
+		expected := 100 * time.Millisecond << uint(attempt)
+		if expected > time.Second {
+			expected = time.Second
+		}
+		assert.Assert(t, delay >= expected/2 && delay <= expected, "attempt %d: %v", attempt, delay)
+	}
+	assert.Equal(t, time.Duration(0), backoffDelay(3, 0, time.Second))
+}
+
 func BenchmarkPostToAPM(b *testing.B) {
 	// Copied from https://github.com/elastic/apm-server/blob/master/testdata/intake-v2/transactions.ndjson.
 	benchBody := []byte(`{"metadata": {"service": {"name": "1234_service-12a3","node": {"configured_name": "node-123"},"version": "5.1.3","environment": "staging","language": {"name": "ecmascript","version": "8"},"runtime": {"name": "node","version": "8.0.0"},"framework": {"name": "Express","version": "1.2.3"},"agent": {"name": "elastic-node","version": "3.14.0"}},"user": {"id": "123user", "username": "bar", "email": "bar@user.com"}, "labels": {"tag0": null, "tag1": "one", "tag2": 2}, "process": {"pid": 1234,"ppid": 6789,"title": "node","argv": ["node","server.js"]},"system": {"hostname": "prod1.example.com","architecture": "x64","platform": "darwin", "container": {"id": "container-id"}, "kubernetes": {"namespace": "namespace1", "pod": {"uid": "pod-uid", "name": "pod-name"}, "node": {"name": "node-name"}}},"cloud":{"account":{"id":"account_id","name":"account_name"},"availability_zone":"cloud_availability_zone","instance":{"id":"instance_id","name":"instance_name"},"machine":{"type":"machine_type"},"project":{"id":"project_id","name":"project_name"},"provider":"cloud_provider","region":"cloud_region","service":{"name":"lambda"}}}}
@@ -121,9 +293,49 @@ func BenchmarkPostToAPM(b *testing.B) {
 	}
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
-		err := PostToApmServer(client, agentData, &config)
+		err := PostToApmServer(context.Background(), client, agentData, &config)
 		if err != nil {
 			b.Fatal(err)
 		}
 	}
 }
+
+func TestSendAgentDataCancelledAtDeadline(t *testing.T) {
+	defer func() { apmServerEndpoints = newEndpointPool() }()
+	// Create apm server that hangs until the test is over
+	hang := make(chan struct{})
+	apmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-hang:
+		case <-r.Context().Done():
+		}
+	}))
+	defer apmServer.Close()
+	defer close(hang)
+
+	config := extensionConfig{
+		apmServerUrl:          apmServer.URL + "/",
+		apmServerMaxRetries:   3,
+		apmServerRetryBackoff: time.Millisecond,
+		// A single failure would open the circuit breaker
+		circuitBreakerThreshold: 1,
+		circuitBreakerCooldown:  time.Minute,
+	}
+	dataBuffer := NewAgentDataBuffer(100, 0, OverflowBlock)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err := SendAgentData(ctx, apmServer.Client(), AgentData{Data: []byte("foo")}, dataBuffer, &config)
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.Assert(t, time.Since(start) < time.Second)
+
+	// The unfinished send is kept for the next attempt
+	assert.Equal(t, 1, dataBuffer.Len())
+
+	// The APM server is not held responsible for the deadline
+	destination := primaryDestination(&config)
+	assert.Equal(t, circuitClosed, destination.breaker.currentState())
+	_, failing := apmServerEndpoints.failedAt[destination.url]
+	assert.Assert(t, !failing)
+}
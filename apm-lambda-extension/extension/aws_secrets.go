@@ -0,0 +1,232 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package extension
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// awsSecretCache holds the values fetched from Secrets Manager and Parameter
+// Store, so that each of them is only fetched once per sandbox. Values are
+// keyed by service, region, endpoint and name.
+var awsSecretCache = struct {
+	sync.Mutex
+	values map[string]string
+}{values: make(map[string]string)}
+
+// awsAPIError is the error returned by an AWS JSON API
+type awsAPIError struct {
+	StatusCode int    `json:"-"`
+	Type       string `json:"__type"`
+	Message    string `json:"message"`
+}
+
+func (e *awsAPIError) Error() string {
+	return fmt.Sprintf("AWS API responded with status code %d: %s %s", e.StatusCode, e.Type, e.Message)
+}
+
+// awsSecretCredentialProvider resolves the secret token and the API key of
+// the APM server from Secrets Manager or Parameter Store, when they are stored
+// there rather than in plaintext environment variables
+type awsSecretCredentialProvider struct {
+	client *http.Client
+	config *extensionConfig
+}
+
+// Credentials returns the credentials stored in AWS, falling back to the
+// plaintext environment variables for those that are not
+func (p *awsSecretCredentialProvider) Credentials() (ApmServerCredentials, error) {
+	credentials := ApmServerCredentials{
+		SecretToken: p.config.apmServerSecretToken,
+		ApiKey:      p.config.apmServerApiKey,
+	}
+	secretToken, err := resolveAwsSecret(p.client, p.config, p.config.secretTokenSecretArn, p.config.secretTokenParameter)
+	if err != nil {
+		return credentials, fmt.Errorf("could not resolve the secret token: %v", err)
+	}
+	if secretToken != "" {
+		credentials.SecretToken = secretToken
+	}
+	apiKey, err := resolveAwsSecret(p.client, p.config, p.config.apiKeySecretArn, p.config.apiKeyParameter)
+	if err != nil {
+		return credentials, fmt.Errorf("could not resolve the API key: %v", err)
+	}
+	if apiKey != "" {
+		credentials.ApiKey = apiKey
+	}
+	return credentials, nil
+}
+
+// Refresh fetches the credentials from AWS again, to pick up rotated values
+func (p *awsSecretCredentialProvider) Refresh() (ApmServerCredentials, error) {
+	awsSecretCache.Lock()
+	delete(awsSecretCache.values, awsSecretKey(p.config, p.config.secretTokenSecretArn, p.config.secretTokenParameter))
+	delete(awsSecretCache.values, awsSecretKey(p.config, p.config.apiKeySecretArn, p.config.apiKeyParameter))
+	awsSecretCache.Unlock()
+	return p.Credentials()
+}
+
+// resolveAwsSecret returns the value of the Secrets Manager secret or of the
+// SSM parameter, whichever is set, or an empty string if neither is
+func resolveAwsSecret(client *http.Client, config *extensionConfig, secretArn string, parameter string) (string, error) {
+	key := awsSecretKey(config, secretArn, parameter)
+	switch {
+	case secretArn != "":
+		return cachedAwsSecret(key, func() (string, error) {
+			return getSecretValue(client, config, secretArn)
+		})
+	case parameter != "":
+		return cachedAwsSecret(key, func() (string, error) {
+			return getParameterValue(client, config, parameter)
+		})
+	default:
+		return "", nil
+	}
+}
+
+// awsSecretKey identifies a value in the cache, so that the same name looked
+// up in another region or through another endpoint is not mixed up with it
+func awsSecretKey(config *extensionConfig, secretArn string, parameter string) string {
+	if secretArn != "" {
+		return strings.Join([]string{"secretsmanager", awsRegion(secretArn, config), config.secretsManagerEndpoint, secretArn}, "|")
+	}
+	return strings.Join([]string{"ssm", awsRegion(parameter, config), config.ssmEndpoint, parameter}, "|")
+}
+
+func cachedAwsSecret(key string, fetch func() (string, error)) (string, error) {
+	awsSecretCache.Lock()
+	defer awsSecretCache.Unlock()
+
+	if value, ok := awsSecretCache.values[key]; ok {
+		return value, nil
+	}
+	value, err := fetch()
+	if err != nil {
+		return "", err
+	}
+	awsSecretCache.values[key] = value
+	return value, nil
+}
+
+// getSecretValue fetches a secret string from Secrets Manager
+func getSecretValue(client *http.Client, config *extensionConfig, secretArn string) (string, error) {
+	region := awsRegion(secretArn, config)
+	endpoint := config.secretsManagerEndpoint
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://secretsmanager.%s.amazonaws.com/", region)
+	}
+
+	var output struct {
+		SecretString string
+		SecretBinary string
+	}
+	input := map[string]interface{}{"SecretId": secretArn}
+	if err := callAwsJSONAPI(client, endpoint, region, "secretsmanager", "secretsmanager.GetSecretValue", input, &output); err != nil {
+		return "", err
+	}
+	value := output.SecretString
+	if value == "" && output.SecretBinary != "" {
+		binary, err := base64.StdEncoding.DecodeString(output.SecretBinary)
+		if err != nil {
+			return "", fmt.Errorf("could not decode the binary secret: %v", err)
+		}
+		value = string(binary)
+	}
+	log.Printf("Retrieved APM server credentials from secret %s", secretArn)
+	return value, nil
+}
+
+// getParameterValue fetches a parameter from Parameter Store, decrypting it
+// if it is a SecureString
+func getParameterValue(client *http.Client, config *extensionConfig, name string) (string, error) {
+	region := awsRegion(name, config)
+	endpoint := config.ssmEndpoint
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://ssm.%s.amazonaws.com/", region)
+	}
+
+	var output struct {
+		Parameter struct {
+			Value string
+		}
+	}
+	input := map[string]interface{}{"Name": name, "WithDecryption": true}
+	if err := callAwsJSONAPI(client, endpoint, region, "ssm", "AmazonSSM.GetParameter", input, &output); err != nil {
+		return "", err
+	}
+	log.Printf("Retrieved APM server credentials from parameter %s", name)
+	return output.Parameter.Value, nil
+}
+
+// awsRegion returns the region of the resource if it is given as an ARN, and
+// the region of the function otherwise
+func awsRegion(resource string, config *extensionConfig) string {
+	parts := strings.SplitN(resource, ":", 5)
+	if len(parts) == 5 && parts[0] == "arn" && parts[3] != "" {
+		return parts[3]
+	}
+	return config.awsRegion
+}
+
+// callAwsJSONAPI sends a signed request to an AWS service speaking the JSON
+// 1.1 protocol, with the function's role credentials
+func callAwsJSONAPI(client *http.Client, endpoint string, region string, service string, target string, input interface{}, output interface{}) error {
+	credentials, err := awsCredentialsFromEnv()
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(input)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", endpoint, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create a new request to %s: %v", service, err)
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", target)
+	signRequestV4(req, hashSHA256(body), credentials, region, service, time.Now())
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to call %s: %v", service, err)
+	}
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read the response body of %s: %v", service, err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		apiErr := &awsAPIError{StatusCode: resp.StatusCode}
+		if err := json.Unmarshal(respBody, apiErr); err != nil {
+			apiErr.Message = string(respBody)
+		}
+		return apiErr
+	}
+	return json.Unmarshal(respBody, output)
+}
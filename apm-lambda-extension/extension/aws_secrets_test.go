@@ -0,0 +1,180 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package extension
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+func setAwsCredentialsEnv() func() {
+	os.Setenv("AWS_ACCESS_KEY_ID", "AKIDEXAMPLE")
+	os.Setenv("AWS_SECRET_ACCESS_KEY", "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY")
+	os.Setenv("AWS_SESSION_TOKEN", "session")
+	return func() {
+		os.Unsetenv("AWS_ACCESS_KEY_ID")
+		os.Unsetenv("AWS_SECRET_ACCESS_KEY")
+		os.Unsetenv("AWS_SESSION_TOKEN")
+	}
+}
+
+// resetAwsSecretCache forgets the values cached by earlier tests
+func resetAwsSecretCache() {
+	awsSecretCache.Lock()
+	awsSecretCache.values = make(map[string]string)
+	awsSecretCache.Unlock()
+}
+
+// newAwsStandIn returns a server standing in for an AWS JSON API, which
+// checks that requests are signed for the service and region
+func newAwsStandIn(t *testing.T, service string, region string, handler func(target string, input map[string]interface{}) (int, interface{})) (*httptest.Server, *int32) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		assert.Equal(t, "application/x-amz-json-1.1", r.Header.Get("Content-Type"))
+		assert.Equal(t, "session", r.Header.Get("X-Amz-Security-Token"))
+		assert.Assert(t, strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/"))
+		assert.Assert(t, strings.Contains(r.Header.Get("Authorization"), "/"+region+"/"+service+"/aws4_request"))
+		assert.Assert(t, strings.Contains(r.Header.Get("Authorization"), "SignedHeaders=content-type;host;x-amz-date;x-amz-security-token;x-amz-target,"))
+
+		var input map[string]interface{}
+		assert.NilError(t, json.NewDecoder(r.Body).Decode(&input))
+		status, output := handler(r.Header.Get("X-Amz-Target"), input)
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(output)
+	}))
+	return server, &requests
+}
+
+func TestResolveSecretTokenFromSecretsManager(t *testing.T) {
+	t.Cleanup(resetAwsSecretCache)
+	defer setAwsCredentialsEnv()()
+	secretArn := "arn:aws:secretsmanager:eu-west-1:123456789012:secret:apm-token-a1b2c3"
+	server, requests := newAwsStandIn(t, "secretsmanager", "eu-west-1", func(target string, input map[string]interface{}) (int, interface{}) {
+		assert.Equal(t, "secretsmanager.GetSecretValue", target)
+		assert.Equal(t, secretArn, input["SecretId"])
+		return http.StatusOK, map[string]interface{}{"ARN": secretArn, "SecretString": "token-from-secret"}
+	})
+	defer server.Close()
+
+	config := extensionConfig{
+		apmServerSecretToken:   "plaintext",
+		secretTokenSecretArn:   secretArn,
+		secretsManagerEndpoint: server.URL,
+		awsRegion:              "us-east-1",
+	}
+	provider := &awsSecretCredentialProvider{client: server.Client(), config: &config}
+	credentials, err := provider.Credentials()
+	assert.NilError(t, err)
+	assert.Equal(t, ApmServerCredentials{SecretToken: "token-from-secret"}, credentials)
+
+	// The value is cached for the lifetime of the sandbox
+	credentials, err = provider.Credentials()
+	assert.NilError(t, err)
+	assert.Equal(t, "token-from-secret", credentials.SecretToken)
+	assert.Equal(t, int32(1), atomic.LoadInt32(requests))
+
+	// Unless it is refreshed
+	_, err = provider.Refresh()
+	assert.NilError(t, err)
+	assert.Equal(t, int32(2), atomic.LoadInt32(requests))
+}
+
+func TestResolveApiKeyFromParameterStore(t *testing.T) {
+	t.Cleanup(resetAwsSecretCache)
+	defer setAwsCredentialsEnv()()
+	server, _ := newAwsStandIn(t, "ssm", "us-east-1", func(target string, input map[string]interface{}) (int, interface{}) {
+		assert.Equal(t, "AmazonSSM.GetParameter", target)
+		assert.Equal(t, "/apm/api-key", input["Name"])
+		assert.Equal(t, true, input["WithDecryption"])
+		return http.StatusOK, map[string]interface{}{
+			"Parameter": map[string]interface{}{"Name": "/apm/api-key", "Type": "SecureString", "Value": "key-from-parameter"},
+		}
+	})
+	defer server.Close()
+
+	config := extensionConfig{
+		apiKeyParameter: "/apm/api-key",
+		ssmEndpoint:     server.URL,
+		awsRegion:       "us-east-1",
+	}
+	credentials, err := (&awsSecretCredentialProvider{client: server.Client(), config: &config}).Credentials()
+	assert.NilError(t, err)
+	assert.Equal(t, ApmServerCredentials{ApiKey: "key-from-parameter"}, credentials)
+}
+
+func TestResolveApmServerCredentialsError(t *testing.T) {
+	t.Cleanup(resetAwsSecretCache)
+	defer setAwsCredentialsEnv()()
+	server, _ := newAwsStandIn(t, "secretsmanager", "us-east-1", func(target string, input map[string]interface{}) (int, interface{}) {
+		return http.StatusBadRequest, map[string]interface{}{
+			"__type":  "ResourceNotFoundException",
+			"Message": "Secrets Manager can't find the specified secret.",
+		}
+	})
+	defer server.Close()
+
+	config := extensionConfig{
+		secretTokenSecretArn:   "missing-secret",
+		secretsManagerEndpoint: server.URL,
+		awsRegion:              "us-east-1",
+	}
+	_, err := (&awsSecretCredentialProvider{client: server.Client(), config: &config}).Credentials()
+	assert.ErrorContains(t, err, "ResourceNotFoundException Secrets Manager can't find the specified secret.")
+}
+
+func TestResolveApmServerCredentialsWithoutAwsCredentials(t *testing.T) {
+	t.Cleanup(resetAwsSecretCache)
+	config := extensionConfig{secretTokenParameter: "/apm/token-without-credentials", awsRegion: "us-east-1"}
+	_, err := (&awsSecretCredentialProvider{client: http.DefaultClient, config: &config}).Credentials()
+	assert.ErrorContains(t, err, "AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY are not set")
+}
+
+func TestAwsSecretCacheIsKeyedByEndpoint(t *testing.T) {
+	t.Cleanup(resetAwsSecretCache)
+	defer setAwsCredentialsEnv()()
+	newServer := func(value string) *httptest.Server {
+		server, _ := newAwsStandIn(t, "ssm", "us-east-1", func(target string, input map[string]interface{}) (int, interface{}) {
+			return http.StatusOK, map[string]interface{}{"Parameter": map[string]interface{}{"Value": value}}
+		})
+		return server
+	}
+	first := newServer("first-key")
+	defer first.Close()
+	second := newServer("second-key")
+	defer second.Close()
+
+	// The same parameter name, looked up through another endpoint, is not
+	// answered from the cache
+	for _, lookup := range []struct {
+		server *httptest.Server
+		want   string
+	}{{first, "first-key"}, {second, "second-key"}} {
+		config := extensionConfig{apiKeyParameter: "/apm/api-key", ssmEndpoint: lookup.server.URL, awsRegion: "us-east-1"}
+		credentials, err := (&awsSecretCredentialProvider{client: lookup.server.Client(), config: &config}).Credentials()
+		assert.NilError(t, err)
+		assert.Equal(t, lookup.want, credentials.ApiKey)
+	}
+}
@@ -0,0 +1,94 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package extension
+
+import (
+	"bytes"
+	"log"
+)
+
+// agentDataBatch collects the events of agent payloads sharing the same metadata
+type agentDataBatch struct {
+	metadata []byte
+	events   bytes.Buffer
+	payloads []AgentData
+}
+
+// batchAgentData coalesces agent payloads into as few intake requests as
+// possible. The intake API only accepts metadata on the first line of a
+// request, so payloads are merged only with others that carry the same
+// metadata, which is then written once at the start of the batch.
+// A batch never holds more than maxPayloads payloads nor, unless a single
+// payload is larger than that, more than maxBytes of uncompressed data.
+// A limit of zero or less is not enforced.
+//
+// Payloads that cannot be decoded are passed on unchanged, and so are
+// batches made of a single payload, to avoid compressing them again. Each
+// batch takes the position of its first payload, so that the agent data
+// keeps the order in which it arrived as much as possible.
+func batchAgentData(agentData []AgentData, maxBytes int, maxPayloads int) []AgentData {
+	var batches []*agentDataBatch
+	open := make(map[string]*agentDataBatch)
+
+	for _, payload := range agentData {
+		data, err := decompressAgentData(payload)
+		if err != nil {
+			log.Printf("Could not batch agent data, sending it separately: %v", err)
+			batches = append(batches, &agentDataBatch{payloads: []AgentData{payload}})
+			continue
+		}
+		metadata, events := splitMetadata(data)
+		if metadata == nil {
+			batches = append(batches, &agentDataBatch{payloads: []AgentData{payload}})
+			continue
+		}
+		if len(events) > 0 && events[len(events)-1] != '\n' {
+			events = append(events[:len(events):len(events)], '\n')
+		}
+
+		batch, ok := open[string(metadata)]
+		if ok {
+			full := maxPayloads > 0 && len(batch.payloads) >= maxPayloads
+			size := len(batch.metadata) + 1 + batch.events.Len() + len(events)
+			if full || (maxBytes > 0 && size > maxBytes) {
+				ok = false
+			}
+		}
+		if !ok {
+			batch = &agentDataBatch{metadata: metadata}
+			open[string(metadata)] = batch
+			batches = append(batches, batch)
+		}
+		batch.events.Write(events)
+		batch.payloads = append(batch.payloads, payload)
+	}
+
+	result := make([]AgentData, 0, len(batches))
+	for _, batch := range batches {
+		if len(batch.payloads) == 1 {
+			result = append(result, batch.payloads[0])
+			continue
+		}
+		data := make([]byte, 0, len(batch.metadata)+1+batch.events.Len())
+		data = append(data, batch.metadata...)
+		data = append(data, '\n')
+		data = append(data, batch.events.Bytes()...)
+		result = append(result, AgentData{Data: data})
+	}
+	return result
+}
@@ -0,0 +1,159 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package extension
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+const (
+	fooMetadata = `{"metadata":{"service":{"name":"foo"}}}`
+	barMetadata = `{"metadata":{"service":{"name":"bar"}}}`
+)
+
+func gzipAgentData(t *testing.T, body string) AgentData {
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	_, err := gw.Write([]byte(body))
+	assert.NilError(t, err)
+	assert.NilError(t, gw.Close())
+	return AgentData{Data: buf.Bytes(), ContentEncoding: "gzip"}
+}
+
+func TestBatchAgentDataMergesSameMetadata(t *testing.T) {
+	batches := batchAgentData([]AgentData{
+		gzipAgentData(t, fooMetadata+"\n"+`{"span":{"id":"1"}}`+"\n"),
+		{Data: []byte(barMetadata + "\n" + `{"span":{"id":"2"}}` + "\n")},
+		{Data: []byte(fooMetadata + "\n" + `{"span":{"id":"3"}}`)},
+	}, 0, 0)
+
+	assert.Equal(t, 2, len(batches))
+	assert.Equal(t, "", batches[0].ContentEncoding)
+	assert.Equal(t, fooMetadata+"\n"+`{"span":{"id":"1"}}`+"\n"+`{"span":{"id":"3"}}`+"\n", string(batches[0].Data))
+	// A batch of a single payload is left untouched
+	assert.Equal(t, barMetadata+"\n"+`{"span":{"id":"2"}}`+"\n", string(batches[1].Data))
+}
+
+func TestBatchAgentDataHonoursLimits(t *testing.T) {
+	payload := AgentData{Data: []byte(fooMetadata + "\n" + `{"span":{"id":"1"}}` + "\n")}
+	payloads := []AgentData{payload, payload, payload, payload, payload}
+
+	batches := batchAgentData(payloads, 0, 2)
+	assert.Equal(t, 3, len(batches))
+
+	// Each batch can hold the metadata and two events
+	maxBytes := len(fooMetadata) + 1 + 2*len(`{"span":{"id":"1"}}`+"\n")
+	batches = batchAgentData(payloads, maxBytes, 0)
+	assert.Equal(t, 3, len(batches))
+	assert.Equal(t, maxBytes, len(batches[0].Data))
+}
+
+func TestBatchAgentDataPassesOnUndecodablePayloads(t *testing.T) {
+	batches := batchAgentData([]AgentData{
+		{Data: []byte("not compressed"), ContentEncoding: "gzip"},
+		{Data: []byte(`{"span":{"id":"1"}}`)},
+	}, 0, 0)
+
+	assert.Equal(t, 2, len(batches))
+	assert.Equal(t, "gzip", batches[0].ContentEncoding)
+	assert.Equal(t, `{"span":{"id":"1"}}`, string(batches[1].Data))
+}
+
+func TestBatchAgentDataKeepsArrivalOrder(t *testing.T) {
+	batches := batchAgentData([]AgentData{
+		{Data: []byte(fooMetadata + "\n" + `{"span":{"id":"1"}}` + "\n")},
+		{Data: []byte(`{"span":{"id":"2"}}`)},
+		{Data: []byte(fooMetadata + "\n" + `{"span":{"id":"3"}}` + "\n")},
+		{Data: []byte(barMetadata + "\n" + `{"span":{"id":"4"}}` + "\n")},
+	}, 0, 0)
+
+	// Each batch or standalone payload is sent at the position of its first payload
+	assert.Equal(t, 3, len(batches))
+	assert.Equal(t, fooMetadata+"\n"+`{"span":{"id":"1"}}`+"\n"+`{"span":{"id":"3"}}`+"\n", string(batches[0].Data))
+	assert.Equal(t, `{"span":{"id":"2"}}`, string(batches[1].Data))
+	assert.Equal(t, barMetadata+"\n"+`{"span":{"id":"4"}}`+"\n", string(batches[2].Data))
+}
+
+func TestSendAgentDataBatchesBufferedData(t *testing.T) {
+	var mu sync.Mutex
+	var bodies []string
+	apmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reader, _ := gzip.NewReader(r.Body)
+		body, _ := ioutil.ReadAll(reader)
+		mu.Lock()
+		bodies = append(bodies, string(body))
+		mu.Unlock()
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer apmServer.Close()
+
+	config := extensionConfig{
+		apmServerUrl:  apmServer.URL + "/",
+		batchMaxBytes: 1024,
+	}
+	dataBuffer := NewAgentDataBuffer(100, 0, OverflowBlock)
+	dataBuffer.Add(AgentData{Data: []byte(fooMetadata + "\n" + `{"span":{"id":"2"}}` + "\n")}, nil)
+	dataBuffer.Add(AgentData{Data: []byte(fooMetadata + "\n" + `{"span":{"id":"3"}}` + "\n")}, nil)
+
+	FlushAPMData(context.Background(), apmServer.Client(), dataBuffer, &config)
+
+	assert.DeepEqual(t, []string{
+		fooMetadata + "\n" + `{"span":{"id":"2"}}` + "\n" + `{"span":{"id":"3"}}` + "\n",
+	}, bodies)
+}
+
+func TestSendAgentDataBatchesByPayloadCount(t *testing.T) {
+	var mu sync.Mutex
+	var bodies []string
+	apmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reader, _ := gzip.NewReader(r.Body)
+		body, _ := ioutil.ReadAll(reader)
+		mu.Lock()
+		bodies = append(bodies, string(body))
+		mu.Unlock()
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer apmServer.Close()
+
+	// Limiting the number of payloads alone enables batching
+	config := extensionConfig{
+		apmServerUrl:     apmServer.URL + "/",
+		batchMaxPayloads: 2,
+	}
+	dataBuffer := NewAgentDataBuffer(100, 0, OverflowBlock)
+	dataBuffer.Add(AgentData{Data: []byte(fooMetadata + "\n" + `{"span":{"id":"1"}}` + "\n")}, nil)
+	dataBuffer.Add(AgentData{Data: []byte(fooMetadata + "\n" + `{"span":{"id":"2"}}` + "\n")}, nil)
+	dataBuffer.Add(AgentData{Data: []byte(fooMetadata + "\n" + `{"span":{"id":"3"}}` + "\n")}, nil)
+	dataBuffer.Add(AgentData{Data: []byte(fooMetadata + "\n" + `{"span":{"id":"4"}}` + "\n")}, nil)
+
+	FlushAPMData(context.Background(), apmServer.Client(), dataBuffer, &config)
+
+	assert.DeepEqual(t, []string{
+		fooMetadata + "\n" + `{"span":{"id":"1"}}` + "\n" + `{"span":{"id":"2"}}` + "\n",
+		fooMetadata + "\n" + `{"span":{"id":"3"}}` + "\n" + `{"span":{"id":"4"}}` + "\n",
+	}, bodies)
+}
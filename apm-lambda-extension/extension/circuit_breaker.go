@@ -0,0 +1,141 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package extension
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+type circuitState int
+
+const (
+	// circuitClosed lets every request through to the APM server
+	circuitClosed circuitState = iota
+	// circuitOpen rejects requests without contacting the APM server
+	circuitOpen
+	// circuitHalfOpen lets a single probe request through to find out
+	// whether the APM server has recovered
+	circuitHalfOpen
+)
+
+func (s circuitState) String() string {
+	switch s {
+	case circuitOpen:
+		return "open"
+	case circuitHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+var errCircuitOpen = errors.New("circuit breaker is open, not sending data to the APM server")
+
+// circuitBreaker keeps track of consecutive failures to send data to the APM
+// server. Once the threshold is reached the breaker opens and further sends
+// fail fast until the cooldown has elapsed, after which a single probe request
+// decides whether to close the breaker again. The state lives as long as the
+// extension process, so it carries over from one invocation to the next.
+type circuitBreaker struct {
+	sync.Mutex
+	state    circuitState
+	failures int
+	openedAt time.Time
+	now      func() time.Time
+}
+
+func newCircuitBreaker() *circuitBreaker {
+	return &circuitBreaker{state: circuitClosed, now: time.Now}
+}
+
+// allow reports whether a request may be sent to the APM server.
+// A threshold of zero or less disables the breaker.
+func (cb *circuitBreaker) allow(threshold int, cooldown time.Duration) bool {
+	if threshold <= 0 {
+		return true
+	}
+	cb.Lock()
+	defer cb.Unlock()
+
+	switch cb.state {
+	case circuitOpen:
+		if cb.now().Sub(cb.openedAt) < cooldown {
+			return false
+		}
+		log.Println("Circuit breaker cooldown elapsed, probing the APM server")
+		cb.state = circuitHalfOpen
+		return true
+	case circuitHalfOpen:
+		// A probe is already in flight
+		return false
+	default:
+		return true
+	}
+}
+
+// recordSuccess closes the breaker and resets the failure count
+func (cb *circuitBreaker) recordSuccess() {
+	cb.Lock()
+	defer cb.Unlock()
+
+	if cb.state != circuitClosed {
+		log.Println("APM server is reachable again, closing circuit breaker")
+	}
+	cb.state = circuitClosed
+	cb.failures = 0
+}
+
+// recordFailure counts a failed send and opens the breaker once the
+// threshold of consecutive failures is reached, or when a probe fails.
+func (cb *circuitBreaker) recordFailure(threshold int) {
+	if threshold <= 0 {
+		return
+	}
+	cb.Lock()
+	defer cb.Unlock()
+
+	cb.failures++
+	if cb.state == circuitHalfOpen || cb.failures >= threshold {
+		if cb.state != circuitOpen {
+			log.Printf("Opening circuit breaker after %d consecutive failures to reach the APM server", cb.failures)
+		}
+		cb.state = circuitOpen
+		cb.openedAt = cb.now()
+	}
+}
+
+// releaseProbe gives up a probe request that was aborted before the APM
+// server could answer it, so that the next request probes the APM server
+// instead. It has no effect on a breaker that is not half-open.
+func (cb *circuitBreaker) releaseProbe() {
+	cb.Lock()
+	defer cb.Unlock()
+
+	if cb.state == circuitHalfOpen {
+		cb.state = circuitOpen
+	}
+}
+
+func (cb *circuitBreaker) currentState() circuitState {
+	cb.Lock()
+	defer cb.Unlock()
+	return cb.state
+}
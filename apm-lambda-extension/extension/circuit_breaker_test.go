@@ -0,0 +1,101 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package extension
+
+import (
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+)
+
+func TestCircuitBreakerOpensAfterThreshold(t *testing.T) {
+	cb := newCircuitBreaker()
+
+	cb.recordFailure(3)
+	cb.recordFailure(3)
+	assert.Equal(t, circuitClosed, cb.currentState())
+	assert.Assert(t, cb.allow(3, time.Minute))
+
+	cb.recordFailure(3)
+	assert.Equal(t, circuitOpen, cb.currentState())
+	assert.Assert(t, !cb.allow(3, time.Minute))
+}
+
+func TestCircuitBreakerSuccessResetsFailures(t *testing.T) {
+	cb := newCircuitBreaker()
+
+	cb.recordFailure(2)
+	cb.recordSuccess()
+	cb.recordFailure(2)
+	assert.Equal(t, circuitClosed, cb.currentState())
+}
+
+func TestCircuitBreakerProbesAfterCooldown(t *testing.T) {
+	now := time.Now()
+	cb := newCircuitBreaker()
+	cb.now = func() time.Time { return now }
+
+	cb.recordFailure(1)
+	assert.Assert(t, !cb.allow(1, time.Minute))
+
+	// Only a single probe is let through once the cooldown has elapsed
+	now = now.Add(time.Minute)
+	assert.Assert(t, cb.allow(1, time.Minute))
+	assert.Equal(t, circuitHalfOpen, cb.currentState())
+	assert.Assert(t, !cb.allow(1, time.Minute))
+
+	// A failed probe opens the breaker for another cooldown
+	cb.recordFailure(1)
+	assert.Equal(t, circuitOpen, cb.currentState())
+	assert.Assert(t, !cb.allow(1, time.Minute))
+
+	// A successful probe closes it
+	now = now.Add(time.Minute)
+	assert.Assert(t, cb.allow(1, time.Minute))
+	cb.recordSuccess()
+	assert.Equal(t, circuitClosed, cb.currentState())
+	assert.Assert(t, cb.allow(1, time.Minute))
+}
+
+func TestCircuitBreakerReleasesAbortedProbe(t *testing.T) {
+	now := time.Now()
+	cb := newCircuitBreaker()
+	cb.now = func() time.Time { return now }
+
+	cb.recordFailure(1)
+	now = now.Add(time.Minute)
+	assert.Assert(t, cb.allow(1, time.Minute))
+	assert.Assert(t, !cb.allow(1, time.Minute))
+
+	// The next request probes the APM server instead
+	cb.releaseProbe()
+	assert.Equal(t, circuitOpen, cb.currentState())
+	assert.Assert(t, cb.allow(1, time.Minute))
+	assert.Equal(t, circuitHalfOpen, cb.currentState())
+}
+
+func TestCircuitBreakerDisabled(t *testing.T) {
+	cb := newCircuitBreaker()
+
+	for i := 0; i < 10; i++ {
+		cb.recordFailure(0)
+	}
+	assert.Equal(t, circuitClosed, cb.currentState())
+	assert.Assert(t, cb.allow(0, time.Minute))
+}
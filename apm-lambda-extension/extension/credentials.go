@@ -0,0 +1,162 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package extension
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ApmServerCredentials authenticate the extension to the APM server. The API
+// key takes precedence over the secret token when both are set.
+type ApmServerCredentials struct {
+	SecretToken string
+	ApiKey      string
+}
+
+// CredentialProvider resolves the credentials of the APM server
+type CredentialProvider interface {
+	// Credentials returns the credentials, possibly from a cache
+	Credentials() (ApmServerCredentials, error)
+	// Refresh resolves the credentials again from their source, after the
+	// APM server rejected the current ones
+	Refresh() (ApmServerCredentials, error)
+}
+
+// staticCredentialProvider returns the credentials set in plaintext
+// environment variables, which cannot change during the sandbox lifetime
+type staticCredentialProvider ApmServerCredentials
+
+func (p staticCredentialProvider) Credentials() (ApmServerCredentials, error) {
+	return ApmServerCredentials(p), nil
+}
+
+func (p staticCredentialProvider) Refresh() (ApmServerCredentials, error) {
+	return ApmServerCredentials(p), nil
+}
+
+// newCredentialProvider returns the provider for the configured source of the
+// APM server credentials
+func newCredentialProvider(config *extensionConfig) CredentialProvider {
+	if config.secretTokenSecretArn != "" || config.secretTokenParameter != "" ||
+		config.apiKeySecretArn != "" || config.apiKeyParameter != "" {
+		return &awsSecretCredentialProvider{
+			client: &http.Client{Timeout: 10 * time.Second},
+			config: config,
+		}
+	}
+	return staticCredentialProvider{
+		SecretToken: config.apmServerSecretToken,
+		ApiKey:      config.apmServerApiKey,
+	}
+}
+
+// credentialManager holds the current APM server credentials, and refreshes
+// them when the APM server rejects them, for instance after a rotation.
+// Refreshes happen at most once per interval, so that credentials that stay
+// invalid do not cause a storm of calls to their source. The credentials are
+// fetched without holding the lock, so that sends with the current
+// credentials are not held up, and concurrent refreshes wait for the one in
+// progress rather than starting their own.
+type credentialManager struct {
+	sync.Mutex
+	provider        CredentialProvider
+	current         ApmServerCredentials
+	refreshInterval time.Duration
+	lastRefresh     time.Time
+	refreshing      chan struct{}
+	now             func() time.Time
+}
+
+func newCredentialManager(provider CredentialProvider, refreshInterval time.Duration) (*credentialManager, error) {
+	credentials, err := provider.Credentials()
+	if err != nil {
+		return nil, err
+	}
+	return &credentialManager{
+		provider:        provider,
+		current:         credentials,
+		refreshInterval: refreshInterval,
+		now:             time.Now,
+	}, nil
+}
+
+func (m *credentialManager) get() ApmServerCredentials {
+	m.Lock()
+	defer m.Unlock()
+	return m.current
+}
+
+// refresh replaces the credentials rejected by the APM server, and reports
+// whether there are new credentials to retry with
+func (m *credentialManager) refresh(rejected ApmServerCredentials) bool {
+	m.Lock()
+	if m.current != rejected {
+		// Already refreshed by a concurrent send
+		m.Unlock()
+		return true
+	}
+	if refreshing := m.refreshing; refreshing != nil {
+		// Wait for the refresh started by a concurrent send
+		m.Unlock()
+		<-refreshing
+		return m.get() != rejected
+	}
+	now := m.now()
+	if !m.lastRefresh.IsZero() && now.Sub(m.lastRefresh) < m.refreshInterval {
+		log.Printf("APM server rejected the credentials, next refresh allowed in %v", m.refreshInterval-now.Sub(m.lastRefresh))
+		m.Unlock()
+		return false
+	}
+	m.lastRefresh = now
+	refreshing := make(chan struct{})
+	m.refreshing = refreshing
+	m.Unlock()
+
+	credentials, err := m.provider.Refresh()
+
+	m.Lock()
+	defer m.Unlock()
+	defer func() {
+		m.refreshing = nil
+		close(refreshing)
+	}()
+	if err != nil {
+		log.Printf("Could not refresh the APM server credentials: %v", err)
+		return false
+	}
+	if credentials == m.current {
+		log.Println("APM server rejected the credentials, which have not changed")
+		return false
+	}
+	log.Println("Refreshed the APM server credentials")
+	m.current = credentials
+	return true
+}
+
+// isAuthError reports whether the APM server rejected the credentials
+func isAuthError(err error) bool {
+	var apmServerErr *ApmServerError
+	if errors.As(err, &apmServerErr) {
+		return apmServerErr.StatusCode == http.StatusUnauthorized || apmServerErr.StatusCode == http.StatusForbidden
+	}
+	return false
+}
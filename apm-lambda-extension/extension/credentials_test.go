@@ -0,0 +1,159 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package extension
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+)
+
+// rotatingCredentialProvider hands out the next secret token on each refresh
+type rotatingCredentialProvider struct {
+	tokens    []string
+	refreshes int32
+}
+
+func (p *rotatingCredentialProvider) Credentials() (ApmServerCredentials, error) {
+	return ApmServerCredentials{SecretToken: p.tokens[0]}, nil
+}
+
+func (p *rotatingCredentialProvider) Refresh() (ApmServerCredentials, error) {
+	refreshes := int(atomic.AddInt32(&p.refreshes, 1))
+	if refreshes >= len(p.tokens) {
+		refreshes = len(p.tokens) - 1
+	}
+	return ApmServerCredentials{SecretToken: p.tokens[refreshes]}, nil
+}
+
+func newAuthenticatingApmServer(validToken string, requests *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(requests, 1)
+		if r.Header.Get("Authorization") != "Bearer "+validToken {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"error": "authentication failed: invalid token"}`))
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+}
+
+func TestPostToApmServerRefreshesRotatedCredentials(t *testing.T) {
+	var requests int32
+	apmServer := newAuthenticatingApmServer("rotated", &requests)
+	defer apmServer.Close()
+
+	provider := &rotatingCredentialProvider{tokens: []string{"expired", "rotated"}}
+	credentials, err := newCredentialManager(provider, time.Minute)
+	assert.NilError(t, err)
+	config := extensionConfig{
+		apmServerUrl: apmServer.URL + "/",
+		credentials:  credentials,
+	}
+
+	err = PostToApmServer(context.Background(), apmServer.Client(), AgentData{Data: []byte("foo")}, &config)
+	assert.NilError(t, err)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&requests))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&provider.refreshes))
+	assert.Equal(t, "rotated", credentials.get().SecretToken)
+}
+
+func TestPostToApmServerRateLimitsCredentialRefreshes(t *testing.T) {
+	var requests int32
+	apmServer := newAuthenticatingApmServer("valid", &requests)
+	defer apmServer.Close()
+
+	provider := &rotatingCredentialProvider{tokens: []string{"bad", "still-bad", "worse"}}
+	credentials, err := newCredentialManager(provider, time.Minute)
+	assert.NilError(t, err)
+	config := extensionConfig{
+		apmServerUrl: apmServer.URL + "/",
+		credentials:  credentials,
+	}
+
+	// The payload is retried once with the refreshed credentials
+	err = PostToApmServer(context.Background(), apmServer.Client(), AgentData{Data: []byte("foo")}, &config)
+	assert.Assert(t, isAuthError(err))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&requests))
+
+	// Later failures do not refresh the credentials until the interval has elapsed
+	for i := 0; i < 3; i++ {
+		err = PostToApmServer(context.Background(), apmServer.Client(), AgentData{Data: []byte("foo")}, &config)
+		assert.Assert(t, isAuthError(err))
+	}
+	assert.Equal(t, int32(5), atomic.LoadInt32(&requests))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&provider.refreshes))
+
+	credentials.now = func() time.Time { return time.Now().Add(2 * time.Minute) }
+	err = PostToApmServer(context.Background(), apmServer.Client(), AgentData{Data: []byte("foo")}, &config)
+	assert.Assert(t, isAuthError(err))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&provider.refreshes))
+}
+
+func TestCredentialManagerUnchangedCredentials(t *testing.T) {
+	credentials, err := newCredentialManager(staticCredentialProvider{ApiKey: "key"}, 0)
+	assert.NilError(t, err)
+
+	// Plaintext credentials cannot be rotated, there is nothing to retry with
+	assert.Assert(t, !credentials.refresh(ApmServerCredentials{ApiKey: "key"}))
+	// Credentials refreshed by a concurrent send are retried right away
+	assert.Assert(t, credentials.refresh(ApmServerCredentials{ApiKey: "old-key"}))
+}
+
+// blockingCredentialProvider hands out a new API key once released
+type blockingCredentialProvider struct {
+	release   chan struct{}
+	refreshes int32
+}
+
+func (p *blockingCredentialProvider) Credentials() (ApmServerCredentials, error) {
+	return ApmServerCredentials{ApiKey: "old-key"}, nil
+}
+
+func (p *blockingCredentialProvider) Refresh() (ApmServerCredentials, error) {
+	atomic.AddInt32(&p.refreshes, 1)
+	<-p.release
+	return ApmServerCredentials{ApiKey: "new-key"}, nil
+}
+
+func TestCredentialManagerRefreshDoesNotBlockSends(t *testing.T) {
+	provider := &blockingCredentialProvider{release: make(chan struct{})}
+	credentials, err := newCredentialManager(provider, 0)
+	assert.NilError(t, err)
+
+	results := make(chan bool, 2)
+	for i := 0; i < 2; i++ {
+		go func() { results <- credentials.refresh(ApmServerCredentials{ApiKey: "old-key"}) }()
+	}
+
+	// Sends keep using the current credentials while the refresh is in progress
+	time.Sleep(20 * time.Millisecond)
+	assert.Equal(t, ApmServerCredentials{ApiKey: "old-key"}, credentials.get())
+
+	// Both rejected sends retry with the credentials of a single refresh
+	close(provider.release)
+	assert.Assert(t, <-results)
+	assert.Assert(t, <-results)
+	assert.Equal(t, ApmServerCredentials{ApiKey: "new-key"}, credentials.get())
+	assert.Equal(t, int32(1), atomic.LoadInt32(&provider.refreshes))
+}
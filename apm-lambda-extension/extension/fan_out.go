@@ -0,0 +1,230 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package extension
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SecondaryDestinationConfig is the configuration of an additional APM server,
+// as read from ELASTIC_APM_LAMBDA_SECONDARY_DESTINATIONS. Like those of the
+// primary APM server, the credentials can be kept in Secrets Manager or
+// Parameter Store, which take precedence over the plaintext ones.
+type SecondaryDestinationConfig struct {
+	URL                  string `json:"url"`
+	SecretToken          string `json:"secret_token"`
+	ApiKey               string `json:"api_key"`
+	SecretTokenSecretArn string `json:"secret_token_secret_arn"`
+	SecretTokenParameter string `json:"secret_token_parameter"`
+	ApiKeySecretArn      string `json:"api_key_secret_arn"`
+	ApiKeyParameter      string `json:"api_key_parameter"`
+}
+
+// credentialConfig returns a copy of the extension configuration holding the
+// credentials of the secondary destination, so that they are resolved in the
+// same way as those of the primary APM server
+func (c SecondaryDestinationConfig) credentialConfig(config *extensionConfig) *extensionConfig {
+	credentialConfig := *config
+	credentialConfig.apmServerSecretToken = c.SecretToken
+	credentialConfig.apmServerApiKey = c.ApiKey
+	credentialConfig.secretTokenSecretArn = c.SecretTokenSecretArn
+	credentialConfig.secretTokenParameter = c.SecretTokenParameter
+	credentialConfig.apiKeySecretArn = c.ApiKeySecretArn
+	credentialConfig.apiKeyParameter = c.ApiKeyParameter
+	return &credentialConfig
+}
+
+// SecondaryStats counts the agent data that the secondary destinations did
+// not deliver, as secondaries never hold up the primary APM server
+type SecondaryStats struct {
+	Dropped int
+	Failed  int
+}
+
+func (s SecondaryStats) String() string {
+	return fmt.Sprintf("dropped by full buffers: %d, failed to send: %d", s.Dropped, s.Failed)
+}
+
+// GetSecondaryStats returns the number of payloads dropped by the secondary
+// destinations since the extension started, either because they fell behind
+// or because they could not be sent
+func GetSecondaryStats() SecondaryStats {
+	var stats SecondaryStats
+	for _, destination := range secondaryDestinations {
+		bufferStats := destination.buffer.Stats()
+		stats.Dropped += bufferStats.DroppedOldest + bufferStats.DroppedNewest
+		destination.mu.Lock()
+		stats.Failed += destination.failed
+		destination.mu.Unlock()
+	}
+	return stats
+}
+
+// secondaryDestination receives a copy of all the agent data sent to the
+// primary APM server. Each one has its own buffer and sends from its own
+// goroutine, so a slow or failing secondary never holds up the primary.
+type secondaryDestination struct {
+	apmServerDestination
+	buffer  *AgentDataBuffer
+	mu      sync.Mutex
+	sending bool
+	failed  int
+}
+
+// secondaryDestinations are the started secondary destinations
+var secondaryDestinations []*secondaryDestination
+
+// parseSecondaryDestinations reads the JSON list of secondary destinations
+func parseSecondaryDestinations(value string) ([]SecondaryDestinationConfig, error) {
+	if strings.TrimSpace(value) == "" {
+		return nil, nil
+	}
+	var destinations []SecondaryDestinationConfig
+	if err := json.Unmarshal([]byte(value), &destinations); err != nil {
+		return nil, fmt.Errorf("could not parse secondary destinations: %v", err)
+	}
+	for i := range destinations {
+		if destinations[i].URL == "" {
+			return nil, fmt.Errorf("secondary destination %d has no url", i)
+		}
+		if !strings.HasSuffix(destinations[i].URL, "/") {
+			destinations[i].URL += "/"
+		}
+	}
+	return destinations, nil
+}
+
+// StartSecondaryDestinations starts sending to the configured secondary
+// destinations. A secondary whose credentials cannot be retrieved is skipped.
+func StartSecondaryDestinations(client *http.Client, config *extensionConfig) {
+	for _, destinationConfig := range config.secondaryDestinations {
+		credentials, err := newCredentialManager(newCredentialProvider(destinationConfig.credentialConfig(config)), config.credentialRefreshInterval)
+		if err != nil {
+			log.Printf("Could not retrieve the credentials of secondary APM server %s, not sending to it: %v", destinationConfig.URL, err)
+			continue
+		}
+		destination := &secondaryDestination{
+			apmServerDestination: apmServerDestination{
+				url:         destinationConfig.URL,
+				credentials: credentials,
+				breaker:     newCircuitBreaker(),
+				limiter:     newRateLimiter(),
+			},
+			buffer: NewAgentDataBuffer(config.AgentDataBufferSize, config.AgentDataBufferBytes, OverflowDropOldest),
+		}
+		secondaryDestinations = append(secondaryDestinations, destination)
+		go destination.run(client, config)
+		log.Printf("Sending a copy of agent data to %s", destination.url)
+	}
+}
+
+func (d *secondaryDestination) run(client *http.Client, config *extensionConfig) {
+	for {
+		agentData := d.next()
+		err := d.send(client, agentData, config)
+		if err != nil {
+			log.Printf("Error sending to secondary APM server %s, skipping: %v", d.url, err)
+		}
+		d.mu.Lock()
+		d.sending = false
+		if err != nil {
+			d.failed++
+		}
+		d.mu.Unlock()
+	}
+}
+
+// send posts the agent data to the secondary destination. Sends are not bound
+// to an invocation deadline, a send interrupted by the sandbox freezing carries
+// on, or is retried, on the next invocation. They have their own timeout
+// instead, so an unresponsive secondary cannot keep the destination busy forever.
+func (d *secondaryDestination) send(client *http.Client, agentData AgentData, config *extensionConfig) error {
+	ctx := context.Background()
+	if config.secondarySendTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, config.secondarySendTimeout)
+		defer cancel()
+	}
+	return postToDestination(ctx, client, &d.apmServerDestination, agentData, config)
+}
+
+// next waits for agent data to send and marks the destination as busy
+func (d *secondaryDestination) next() AgentData {
+	for {
+		d.mu.Lock()
+		agentData, ok := d.buffer.TryGet()
+		d.sending = ok
+		d.mu.Unlock()
+		if ok {
+			return agentData
+		}
+		<-d.buffer.available
+	}
+}
+
+func (d *secondaryDestination) idle() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return !d.sending && d.buffer.Len() == 0
+}
+
+// fanOut hands a copy of the agent data to every secondary destination.
+// Secondaries that fall behind drop their oldest data.
+func fanOut(agentData AgentData) {
+	for _, destination := range secondaryDestinations {
+		destination.buffer.Add(agentData, nil)
+	}
+}
+
+// WaitForSecondaryDestinations gives the secondary destinations a short grace
+// period, bound by the context, to send the agent data they hold. The end of
+// the invocation is not held up any longer than that, whatever is left is sent
+// on the next invocation.
+func WaitForSecondaryDestinations(ctx context.Context, config *extensionConfig) {
+	if len(secondaryDestinations) == 0 || config.secondaryGracePeriod <= 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, config.secondaryGracePeriod)
+	defer cancel()
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		pending := 0
+		for _, destination := range secondaryDestinations {
+			if !destination.idle() {
+				pending++
+			}
+		}
+		if pending == 0 {
+			return
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			log.Printf("%d secondary APM servers still have agent data to send", pending)
+			return
+		}
+	}
+}
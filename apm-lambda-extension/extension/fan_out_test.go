@@ -0,0 +1,207 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package extension
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+)
+
+func TestParseSecondaryDestinations(t *testing.T) {
+	destinations, err := parseSecondaryDestinations(`[{"url": "https://sandbox.example.com", "api_key": "foo"}, {"url": "https://other.example.com/", "secret_token": "bar"}, {"url": "https://third.example.com/", "api_key_parameter": "/apm/api-key"}]`)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, []SecondaryDestinationConfig{
+		{URL: "https://sandbox.example.com/", ApiKey: "foo"},
+		{URL: "https://other.example.com/", SecretToken: "bar"},
+		{URL: "https://third.example.com/", ApiKeyParameter: "/apm/api-key"},
+	}, destinations)
+
+	destinations, err = parseSecondaryDestinations("")
+	assert.NilError(t, err)
+	assert.Equal(t, 0, len(destinations))
+
+	_, err = parseSecondaryDestinations(`[{"api_key": "foo"}]`)
+	assert.Assert(t, err != nil)
+
+	_, err = parseSecondaryDestinations(`not json`)
+	assert.Assert(t, err != nil)
+}
+
+func TestFanOutToSecondaryDestinations(t *testing.T) {
+	defer func() { secondaryDestinations = nil }()
+
+	// Create a secondary apm server that is slow to respond
+	var received int32
+	release := make(chan struct{})
+	secondary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		assert.Equal(t, "ApiKey secondary-key", r.Header.Get("Authorization"))
+		ioutil.ReadAll(r.Body)
+		atomic.AddInt32(&received, 1)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer secondary.Close()
+	defer close(release)
+
+	config := extensionConfig{
+		AgentDataBufferSize:  10,
+		secondaryGracePeriod: 5 * time.Second,
+		secondaryDestinations: []SecondaryDestinationConfig{
+			{URL: secondary.URL + "/", ApiKey: "secondary-key"},
+		},
+	}
+	StartSecondaryDestinations(secondary.Client(), &config)
+
+	fanOut(AgentData{Data: []byte("foo")})
+	fanOut(AgentData{Data: []byte("bar")})
+
+	// Waiting for a slow secondary gives up at the deadline
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	WaitForSecondaryDestinations(ctx, &config)
+	assert.Assert(t, time.Since(start) < time.Second)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&received))
+
+	release <- struct{}{}
+	release <- struct{}{}
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	WaitForSecondaryDestinations(ctx, &config)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&received))
+}
+
+func TestUnresponsiveSecondaryDestination(t *testing.T) {
+	defer func() { secondaryDestinations = nil }()
+
+	// Create a secondary apm server that never responds
+	release := make(chan struct{})
+	secondary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer secondary.Close()
+	defer close(release)
+
+	config := extensionConfig{
+		AgentDataBufferSize:  10,
+		secondarySendTimeout: 50 * time.Millisecond,
+		secondaryGracePeriod: 20 * time.Millisecond,
+		secondaryDestinations: []SecondaryDestinationConfig{
+			{URL: secondary.URL + "/"},
+		},
+	}
+	StartSecondaryDestinations(secondary.Client(), &config)
+	fanOut(AgentData{Data: []byte("foo")})
+
+	// The end of the invocation only waits for the grace period
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	WaitForSecondaryDestinations(ctx, &config)
+	assert.Assert(t, time.Since(start) < time.Second)
+
+	// The send times out, and the destination is no longer busy
+	assert.Assert(t, !secondaryDestinations[0].idle())
+	time.Sleep(200 * time.Millisecond)
+	assert.Assert(t, secondaryDestinations[0].idle())
+}
+
+func TestSecondaryDestinationCredentialsFromParameterStore(t *testing.T) {
+	defer func() { secondaryDestinations = nil }()
+	t.Cleanup(resetAwsSecretCache)
+	defer setAwsCredentialsEnv()()
+	ssm, _ := newAwsStandIn(t, "ssm", "us-east-1", func(target string, input map[string]interface{}) (int, interface{}) {
+		assert.Equal(t, "/apm/secondary-key", input["Name"])
+		return http.StatusOK, map[string]interface{}{
+			"Parameter": map[string]interface{}{"Name": "/apm/secondary-key", "Type": "SecureString", "Value": "key-from-parameter"},
+		}
+	})
+	defer ssm.Close()
+
+	var received int32
+	secondary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "ApiKey key-from-parameter", r.Header.Get("Authorization"))
+		ioutil.ReadAll(r.Body)
+		atomic.AddInt32(&received, 1)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer secondary.Close()
+
+	config := extensionConfig{
+		AgentDataBufferSize:  10,
+		secondaryGracePeriod: 5 * time.Second,
+		ssmEndpoint:          ssm.URL,
+		awsRegion:            "us-east-1",
+		// The secret of the primary APM server is not used for the secondary
+		apiKeyParameter: "/apm/primary-key",
+		secondaryDestinations: []SecondaryDestinationConfig{
+			{URL: secondary.URL + "/", ApiKey: "plaintext-key", ApiKeyParameter: "/apm/secondary-key"},
+		},
+	}
+	StartSecondaryDestinations(secondary.Client(), &config)
+	fanOut(AgentData{Data: []byte("foo")})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	WaitForSecondaryDestinations(ctx, &config)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&received))
+}
+
+func TestSecondaryStatsCountDroppedAgentData(t *testing.T) {
+	defer func() { secondaryDestinations = nil }()
+
+	// Create a secondary apm server that rejects everything after a while
+	release := make(chan struct{})
+	secondary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		ioutil.ReadAll(r.Body)
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer secondary.Close()
+
+	config := extensionConfig{
+		AgentDataBufferSize:  1,
+		secondaryGracePeriod: 5 * time.Second,
+		secondaryDestinations: []SecondaryDestinationConfig{
+			{URL: secondary.URL + "/"},
+		},
+	}
+	StartSecondaryDestinations(secondary.Client(), &config)
+
+	// The first payload is being sent, the second one is dropped by the
+	// full buffer when the third one comes in
+	fanOut(AgentData{Data: []byte("first")})
+	for secondaryDestinations[0].buffer.Len() > 0 {
+		time.Sleep(time.Millisecond)
+	}
+	fanOut(AgentData{Data: []byte("second")})
+	fanOut(AgentData{Data: []byte("third")})
+	close(release)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	WaitForSecondaryDestinations(ctx, &config)
+	assert.Equal(t, SecondaryStats{Dropped: 1, Failed: 2}, GetSecondaryStats())
+}
@@ -0,0 +1,224 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package extension
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"os"
+	"strings"
+	"sync"
+
+	"elastic/apm-lambda-extension/logsapi"
+)
+
+// functionLogsFlushBytes is the size of the function log events collected
+// before they are added to the agent data buffer, if no platform event
+// comes first
+const functionLogsFlushBytes = 64 * 1024
+
+// closedChannel makes blocking buffer operations give up right away
+var closedChannel = func() chan struct{} {
+	c := make(chan struct{})
+	close(c)
+	return c
+}()
+
+// FunctionLogForwarder turns the function logs received from the Logs API
+// into intake v2 log events, and adds them to the agent data buffer so that
+// they are sent to the APM server along with the agent data. Log events are
+// attributed to the invocation announced by the last platform.start event, and
+// to the trace of the APM agent when the log line carries its trace context.
+type FunctionLogForwarder struct {
+	sync.Mutex
+	agentDataBuffer *AgentDataBuffer
+	metadata        []byte
+	requestID       string
+	events          bytes.Buffer
+}
+
+type functionLogEvent struct {
+	Log functionLog `json:"log"`
+}
+
+type functionLog struct {
+	Timestamp     int64           `json:"@timestamp"`
+	Message       string          `json:"message"`
+	Level         string          `json:"log.level,omitempty"`
+	TraceID       string          `json:"trace.id,omitempty"`
+	TransactionID string          `json:"transaction.id,omitempty"`
+	SpanID        string          `json:"span.id,omitempty"`
+	FaaS          functionLogFaaS `json:"faas"`
+}
+
+type functionLogFaaS struct {
+	Execution string `json:"execution,omitempty"`
+}
+
+// functionLogRecord is the record of function logs in the JSON log format
+type functionLogRecord struct {
+	Message   string `json:"message"`
+	Level     string `json:"level"`
+	RequestID string `json:"requestId"`
+}
+
+// NewFunctionLogForwarder returns a forwarder adding log events to the buffer
+func NewFunctionLogForwarder(agentDataBuffer *AgentDataBuffer) *FunctionLogForwarder {
+	return &FunctionLogForwarder{
+		agentDataBuffer: agentDataBuffer,
+		metadata:        functionMetadata(),
+	}
+}
+
+// functionMetadata describes the function in the metadata line of the intake
+// requests holding its logs and metrics
+func functionMetadata() []byte {
+	serviceName := os.Getenv("ELASTIC_APM_SERVICE_NAME")
+	if serviceName == "" {
+		serviceName = os.Getenv("AWS_LAMBDA_FUNCTION_NAME")
+	}
+	metadata := map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"service": map[string]interface{}{
+				"name":    serviceName,
+				"version": os.Getenv("AWS_LAMBDA_FUNCTION_VERSION"),
+				"agent": map[string]string{
+					"name":    "apm-lambda-extension",
+					"version": "unknown",
+				},
+			},
+			"cloud": map[string]interface{}{
+				"provider": "aws",
+				"region":   os.Getenv("AWS_REGION"),
+				"service":  map[string]string{"name": "lambda"},
+			},
+		},
+	}
+	data, _ := json.Marshal(metadata)
+	return append(data, '\n')
+}
+
+// Process handles an event from the Logs API. Function logs are collected
+// until the invocation starts or ends, or until enough of them were collected.
+func (f *FunctionLogForwarder) Process(logEvent logsapi.LogEvent) {
+	switch {
+	case logsapi.SubEventType(logEvent.Type) == logsapi.PlatformStart:
+		f.Flush()
+		f.Lock()
+		f.requestID = logEvent.Record.RequestId
+		f.Unlock()
+	case logsapi.SubEventType(logEvent.Type) == logsapi.RuntimeDone:
+		f.Flush()
+	case logsapi.EventType(logEvent.Type) == logsapi.Function:
+		f.Lock()
+		f.addLogEvent(logEvent)
+		full := f.events.Len() >= functionLogsFlushBytes
+		f.Unlock()
+		if full {
+			f.Flush()
+		}
+	}
+}
+
+func (f *FunctionLogForwarder) addLogEvent(logEvent logsapi.LogEvent) {
+	event := functionLogEvent{Log: functionLog{
+		Timestamp: logEvent.Time.UnixNano() / 1000,
+		FaaS:      functionLogFaaS{Execution: f.requestID},
+	}}
+	var message string
+	var record functionLogRecord
+	if err := json.Unmarshal(logEvent.RawRecord, &message); err == nil {
+		event.Log.Message = strings.TrimRight(message, "\n")
+		if trimmed := strings.TrimSpace(message); strings.HasPrefix(trimmed, "{") {
+			setLogTraceContext(&event.Log, []byte(trimmed))
+		}
+	} else if err := json.Unmarshal(logEvent.RawRecord, &record); err == nil {
+		event.Log.Message = record.Message
+		event.Log.Level = strings.ToLower(record.Level)
+		if record.RequestID != "" {
+			event.Log.FaaS.Execution = record.RequestID
+		}
+		setLogTraceContext(&event.Log, logEvent.RawRecord)
+	} else {
+		event.Log.Message = string(logEvent.RawRecord)
+	}
+
+	data, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("Could not encode function log event: %v", err)
+		return
+	}
+	f.events.Write(data)
+	f.events.WriteByte('\n')
+}
+
+// setLogTraceContext copies the trace context that the log correlation of the
+// APM agents adds to JSON log lines, as dotted or nested ECS fields
+func setLogTraceContext(event *functionLog, line []byte) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(line, &fields); err != nil {
+		return
+	}
+	event.TraceID = ecsID(fields, "trace")
+	event.TransactionID = ecsID(fields, "transaction")
+	event.SpanID = ecsID(fields, "span")
+}
+
+// ecsID returns the value of the <name>.id field, or of the id field of the
+// <name> object
+func ecsID(fields map[string]json.RawMessage, name string) string {
+	var id string
+	if err := json.Unmarshal(fields[name+".id"], &id); err == nil {
+		return id
+	}
+	var object struct {
+		ID string `json:"id"`
+	}
+	if err := json.Unmarshal(fields[name], &object); err == nil {
+		return object.ID
+	}
+	return ""
+}
+
+// Flush adds the log events collected so far to the agent data buffer
+func (f *FunctionLogForwarder) Flush() {
+	f.Lock()
+	if f.events.Len() == 0 {
+		f.Unlock()
+		return
+	}
+	data := make([]byte, 0, len(f.metadata)+f.events.Len())
+	data = append(append(data, f.metadata...), f.events.Bytes()...)
+	f.events.Reset()
+	f.Unlock()
+
+	bufferLogsAPIData(f.agentDataBuffer, data, "function logs")
+}
+
+// bufferLogsAPIData adds the data derived from Logs API events to the agent
+// data buffer. The Logs API is not kept waiting for room in the buffer, data
+// that does not fit is dropped.
+func bufferLogsAPIData(agentDataBuffer *AgentDataBuffer, data []byte, description string) {
+	agentData := AgentData{Data: data}
+	if err := agentDataBuffer.Add(agentData, closedChannel); err != nil {
+		log.Printf("Dropping %s: %v", description, err)
+		return
+	}
+	fanOut(agentData)
+}
@@ -0,0 +1,148 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package extension
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"testing"
+	"time"
+
+	"elastic/apm-lambda-extension/logsapi"
+
+	"gotest.tools/assert"
+)
+
+func newLogEvent(eventType string, requestID string, record string) logsapi.LogEvent {
+	return logsapi.LogEvent{
+		Time:      time.Date(2021, 10, 20, 8, 13, 3, 278000000, time.UTC),
+		Type:      eventType,
+		RawRecord: json.RawMessage(record),
+		Record:    logsapi.LogEventRecord{RequestId: requestID},
+	}
+}
+
+func TestFunctionLogForwarder(t *testing.T) {
+	os.Setenv("AWS_LAMBDA_FUNCTION_NAME", "test-function")
+	defer os.Unsetenv("AWS_LAMBDA_FUNCTION_NAME")
+
+	dataBuffer := NewAgentDataBuffer(100, 0, OverflowBlock)
+	forwarder := NewFunctionLogForwarder(dataBuffer)
+
+	forwarder.Process(newLogEvent("platform.start", "first-request", `{"requestId": "first-request"}`))
+	forwarder.Process(newLogEvent("function", "", `"2021-10-20T08:13:03.278Z\tfirst-request\tINFO\tHello world\n"`))
+	forwarder.Process(newLogEvent("function", "", `{"message": "Structured", "level": "WARN", "requestId": "other-request"}`))
+	assert.Equal(t, 0, dataBuffer.Len())
+	forwarder.Process(newLogEvent("platform.runtimeDone", "first-request", `{"requestId": "first-request"}`))
+	assert.Equal(t, 1, dataBuffer.Len())
+
+	agentData, _ := dataBuffer.TryGet()
+	assert.Equal(t, "", agentData.ContentEncoding)
+	_, _, errs := validateIntakeEvents(agentData)
+	assert.Assert(t, len(errs) == 0)
+	lines := bytes.Split(bytes.TrimSpace(agentData.Data), []byte("\n"))
+	assert.Equal(t, 3, len(lines))
+
+	var metadata struct {
+		Metadata struct {
+			Service struct {
+				Name string `json:"name"`
+			} `json:"service"`
+		} `json:"metadata"`
+	}
+	assert.NilError(t, json.Unmarshal(lines[0], &metadata))
+	assert.Equal(t, "test-function", metadata.Metadata.Service.Name)
+
+	var event functionLogEvent
+	assert.NilError(t, json.Unmarshal(lines[1], &event))
+	assert.DeepEqual(t, functionLog{
+		Timestamp: 1634717583278000,
+		Message:   "2021-10-20T08:13:03.278Z\tfirst-request\tINFO\tHello world",
+		FaaS:      functionLogFaaS{Execution: "first-request"},
+	}, event.Log)
+	assert.NilError(t, json.Unmarshal(lines[2], &event))
+	assert.DeepEqual(t, functionLog{
+		Timestamp: 1634717583278000,
+		Message:   "Structured",
+		Level:     "warn",
+		FaaS:      functionLogFaaS{Execution: "other-request"},
+	}, event.Log)
+}
+
+func TestFunctionLogForwarderKeepsTraceContext(t *testing.T) {
+	dataBuffer := NewAgentDataBuffer(100, 0, OverflowBlock)
+	forwarder := NewFunctionLogForwarder(dataBuffer)
+
+	forwarder.Process(newLogEvent("platform.start", "request", `{"requestId": "request"}`))
+	// An ECS log line written to stdout, with dotted fields
+	forwarder.Process(newLogEvent("function", "", `"{\"message\": \"Plain\", \"trace.id\": \"trace-1\", \"transaction.id\": \"transaction-1\"}\n"`))
+	// A structured log record, with nested fields
+	forwarder.Process(newLogEvent("function", "", `{"message": "Structured", "level": "INFO", "trace": {"id": "trace-2"}, "transaction": {"id": "transaction-2"}, "span": {"id": "span-2"}}`))
+	// Fields that are not a trace context are ignored
+	forwarder.Process(newLogEvent("function", "", `{"message": "Other", "trace": "yes"}`))
+	forwarder.Flush()
+
+	agentData, _ := dataBuffer.TryGet()
+	lines := bytes.Split(bytes.TrimSpace(agentData.Data), []byte("\n"))
+	assert.Equal(t, 4, len(lines))
+	var event functionLogEvent
+	assert.NilError(t, json.Unmarshal(lines[1], &event))
+	assert.Equal(t, "trace-1", event.Log.TraceID)
+	assert.Equal(t, "transaction-1", event.Log.TransactionID)
+	assert.Equal(t, "", event.Log.SpanID)
+	assert.Equal(t, "request", event.Log.FaaS.Execution)
+	event = functionLogEvent{}
+	assert.NilError(t, json.Unmarshal(lines[2], &event))
+	assert.Equal(t, "trace-2", event.Log.TraceID)
+	assert.Equal(t, "transaction-2", event.Log.TransactionID)
+	assert.Equal(t, "span-2", event.Log.SpanID)
+	event = functionLogEvent{}
+	assert.NilError(t, json.Unmarshal(lines[3], &event))
+	assert.Equal(t, "", event.Log.TraceID)
+}
+
+func TestFunctionLogForwarderAttributesLateLogs(t *testing.T) {
+	dataBuffer := NewAgentDataBuffer(100, 0, OverflowBlock)
+	forwarder := NewFunctionLogForwarder(dataBuffer)
+
+	// Logs received after the invocation ended are flushed when the next
+	// invocation starts, and keep the request ID of their invocation
+	forwarder.Process(newLogEvent("platform.start", "first-request", `{"requestId": "first-request"}`))
+	forwarder.Process(newLogEvent("function", "", `"late line"`))
+	forwarder.Process(newLogEvent("platform.start", "second-request", `{"requestId": "second-request"}`))
+	forwarder.Process(newLogEvent("function", "", `"next line"`))
+	forwarder.Flush()
+	assert.Equal(t, 2, dataBuffer.Len())
+
+	agentData, _ := dataBuffer.TryGet()
+	assert.Assert(t, bytes.Contains(agentData.Data, []byte(`"message":"late line","faas":{"execution":"first-request"}`)))
+	agentData, _ = dataBuffer.TryGet()
+	assert.Assert(t, bytes.Contains(agentData.Data, []byte(`"message":"next line","faas":{"execution":"second-request"}`)))
+}
+
+func TestFunctionLogForwarderDoesNotBlockOnFullBuffer(t *testing.T) {
+	dataBuffer := NewAgentDataBuffer(1, 0, OverflowBlock)
+	dataBuffer.Add(AgentData{Data: []byte("{}")}, nil)
+	forwarder := NewFunctionLogForwarder(dataBuffer)
+
+	forwarder.Process(newLogEvent("function", "", `"dropped line"`))
+	forwarder.Flush()
+	assert.Equal(t, 1, dataBuffer.Len())
+	assert.Equal(t, 1, dataBuffer.Stats().Rejected)
+}
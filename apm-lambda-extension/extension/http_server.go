@@ -26,10 +26,15 @@ import (
 
 var agentDataServer *http.Server
 
-func StartHttpServer(agentDataChan chan AgentData, config *extensionConfig) (err error) {
+func StartHttpServer(client *http.Client, agentDataBuffer *AgentDataBuffer, config *extensionConfig) (err error) {
 	mux := http.NewServeMux()
-	mux.HandleFunc("/", handleInfoRequest(config.apmServerUrl))
-	mux.HandleFunc("/intake/v2/events", handleIntakeV2Events(agentDataChan))
+	mux.HandleFunc("/", handleInfoRequest(client, config))
+	// Only agents sending intake requests are registered, and waited for
+	if config.passthroughAgentData {
+		mux.Handle("/intake/v2/events", withInvocation(http.HandlerFunc(handleIntakeV2EventsPassthrough(client, agentDataBuffer, config))))
+	} else {
+		mux.Handle("/intake/v2/events", withInvocation(http.HandlerFunc(handleIntakeV2Events(agentDataBuffer, config))))
+	}
 	timeout := time.Duration(config.dataReceiverTimeoutSeconds) * time.Second
 	agentDataServer = &http.Server{
 		Addr:           config.dataReceiverServerPort,
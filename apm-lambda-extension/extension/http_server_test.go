@@ -19,6 +19,7 @@ package extension
 
 import (
 	"bytes"
+	"errors"
 	"io/ioutil"
 	"net"
 	"net/http"
@@ -31,6 +32,7 @@ import (
 )
 
 func TestInfoProxy(t *testing.T) {
+	defer func() { registeredAgents = newAgentRegistry() }()
 	headers := map[string]string{"Authorization": "test-value"}
 	wantResp := "{\"foo\": \"bar\"}"
 
@@ -46,7 +48,7 @@ func TestInfoProxy(t *testing.T) {
 	defer apmServer.Close()
 
 	// Create extension config and start the server
-	dataChannel := make(chan AgentData, 100)
+	dataBuffer := NewAgentDataBuffer(100, 0, OverflowBlock)
 	config := extensionConfig{
 		apmServerUrl:               apmServer.URL,
 		apmServerSecretToken:       "foo",
@@ -55,7 +57,7 @@ func TestInfoProxy(t *testing.T) {
 		dataReceiverTimeoutSeconds: 15,
 	}
 
-	StartHttpServer(dataChannel, &config)
+	StartHttpServer(&http.Client{}, dataBuffer, &config)
 	defer agentDataServer.Close()
 
 	hosts, _ := net.LookupHost("localhost")
@@ -82,6 +84,8 @@ func TestInfoProxy(t *testing.T) {
 		assert.Equal(t, "header", resp.Header.Get("test"))
 		resp.Body.Close()
 	}
+	// Info requests do not register the agent
+	assert.Equal(t, 0, len(registeredAgents.list()))
 }
 
 func TestInfoProxyErrorStatusCode(t *testing.T) {
@@ -92,7 +96,7 @@ func TestInfoProxyErrorStatusCode(t *testing.T) {
 	defer apmServer.Close()
 
 	// Create extension config and start the server
-	dataChannel := make(chan AgentData, 100)
+	dataBuffer := NewAgentDataBuffer(100, 0, OverflowBlock)
 	config := extensionConfig{
 		apmServerUrl:               apmServer.URL,
 		apmServerSecretToken:       "foo",
@@ -101,7 +105,7 @@ func TestInfoProxyErrorStatusCode(t *testing.T) {
 		dataReceiverTimeoutSeconds: 15,
 	}
 
-	StartHttpServer(dataChannel, &config)
+	StartHttpServer(&http.Client{}, dataBuffer, &config)
 	defer agentDataServer.Close()
 
 	hosts, _ := net.LookupHost("localhost")
@@ -133,7 +137,7 @@ func Test_handleInfoRequest(t *testing.T) {
 `
 
 	// Create extension config
-	dataChannel := make(chan AgentData, 100)
+	dataBuffer := NewAgentDataBuffer(100, 0, OverflowBlock)
 	config := extensionConfig{
 		apmServerSecretToken:       "foo",
 		apmServerApiKey:            "bar",
@@ -142,7 +146,7 @@ func Test_handleInfoRequest(t *testing.T) {
 	}
 
 	// Start extension server
-	StartHttpServer(dataChannel, &config)
+	StartHttpServer(&http.Client{}, dataBuffer, &config)
 	defer agentDataServer.Close()
 
 	// Create a request to send to the extension
@@ -169,9 +173,10 @@ func Test_handleInfoRequest(t *testing.T) {
 }
 
 func Test_handleIntakeV2EventsQueryParam(t *testing.T) {
-	body := []byte(`{"metadata": {}`)
+	body := []byte(`{"metadata": {}}`)
 
-	AgentDoneSignal = make(chan struct{})
+	invocation := StartInvocation("test-request", time.Now().Add(time.Minute))
+	defer invocation.End()
 
 	// Create apm server and handler
 	apmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -179,14 +184,14 @@ func Test_handleIntakeV2EventsQueryParam(t *testing.T) {
 	defer apmServer.Close()
 
 	// Create extension config and start the server
-	dataChannel := make(chan AgentData, 100)
+	dataBuffer := NewAgentDataBuffer(100, 0, OverflowBlock)
 	config := extensionConfig{
 		apmServerUrl:               apmServer.URL,
 		dataReceiverServerPort:     ":1234",
 		dataReceiverTimeoutSeconds: 15,
 	}
 
-	StartHttpServer(dataChannel, &config)
+	StartHttpServer(&http.Client{}, dataBuffer, &config)
 	defer agentDataServer.Close()
 
 	hosts, _ := net.LookupHost("localhost")
@@ -212,8 +217,8 @@ func Test_handleIntakeV2EventsQueryParam(t *testing.T) {
 	defer timer.Stop()
 
 	select {
-	case <-AgentDoneSignal:
-		<-dataChannel
+	case <-invocation.AgentDone():
+		dataBuffer.Get(nil)
 	case <-timer.C:
 		t.Log("Timed out waiting for server to send FuncDone signal")
 		t.Fail()
@@ -221,7 +226,7 @@ func Test_handleIntakeV2EventsQueryParam(t *testing.T) {
 }
 
 func Test_handleIntakeV2EventsNoQueryParam(t *testing.T) {
-	body := []byte(`{"metadata": {}`)
+	body := []byte(`{"metadata": {}}`)
 
 	// Create apm server and handler
 	apmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -229,14 +234,14 @@ func Test_handleIntakeV2EventsNoQueryParam(t *testing.T) {
 	defer apmServer.Close()
 
 	// Create extension config and start the server
-	dataChannel := make(chan AgentData, 100)
+	dataBuffer := NewAgentDataBuffer(100, 0, OverflowBlock)
 	config := extensionConfig{
 		apmServerUrl:               apmServer.URL,
 		dataReceiverServerPort:     ":1234",
 		dataReceiverTimeoutSeconds: 15,
 	}
 
-	StartHttpServer(dataChannel, &config)
+	StartHttpServer(&http.Client{}, dataBuffer, &config)
 	defer agentDataServer.Close()
 
 	hosts, _ := net.LookupHost("localhost")
@@ -255,14 +260,15 @@ func Test_handleIntakeV2EventsNoQueryParam(t *testing.T) {
 		t.Logf("Error fetching %s, [%v]", agentDataServer.Addr, err)
 		t.Fail()
 	}
-	<-dataChannel
+	dataBuffer.Get(nil)
 	assert.Equal(t, 202, resp.StatusCode)
 }
 
 func Test_handleIntakeV2EventsQueryParamEmptyData(t *testing.T) {
 	body := []byte(``)
 
-	AgentDoneSignal = make(chan struct{})
+	invocation := StartInvocation("test-request", time.Now().Add(time.Minute))
+	defer invocation.End()
 
 	// Create apm server and handler
 	apmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -270,14 +276,14 @@ func Test_handleIntakeV2EventsQueryParamEmptyData(t *testing.T) {
 	defer apmServer.Close()
 
 	// Create extension config and start the server
-	dataChannel := make(chan AgentData, 100)
+	dataBuffer := NewAgentDataBuffer(100, 0, OverflowBlock)
 	config := extensionConfig{
 		apmServerUrl:               apmServer.URL,
 		dataReceiverServerPort:     ":1234",
 		dataReceiverTimeoutSeconds: 15,
 	}
 
-	StartHttpServer(dataChannel, &config)
+	StartHttpServer(&http.Client{}, dataBuffer, &config)
 	defer agentDataServer.Close()
 
 	hosts, _ := net.LookupHost("localhost")
@@ -303,9 +309,82 @@ func Test_handleIntakeV2EventsQueryParamEmptyData(t *testing.T) {
 	defer timer.Stop()
 
 	select {
-	case <-AgentDoneSignal:
+	case <-invocation.AgentDone():
 	case <-timer.C:
 		t.Log("Timed out waiting for server to send FuncDone signal")
 		t.Fail()
 	}
 }
+
+func Test_handleIntakeV2EventsBufferFull(t *testing.T) {
+	body := []byte(`{"metadata": {}}`)
+
+	// Create extension config and start the server with a full buffer
+	dataBuffer := NewAgentDataBuffer(1, 0, OverflowReject)
+	dataBuffer.Add(AgentData{Data: body}, nil)
+	config := extensionConfig{
+		dataReceiverServerPort:     ":1234",
+		dataReceiverTimeoutSeconds: 15,
+		intakeRetryAfter:           time.Second,
+	}
+
+	StartHttpServer(&http.Client{}, dataBuffer, &config)
+	defer agentDataServer.Close()
+
+	hosts, _ := net.LookupHost("localhost")
+	url := "http://" + hosts[0] + ":1234/intake/v2/events"
+
+	// Send the request to the extension
+	client := &http.Client{}
+	resp, err := client.Post(url, "application/x-ndjson", bytes.NewReader(body))
+	if err != nil {
+		t.Logf("Error fetching %s, [%v]", agentDataServer.Addr, err)
+		t.Fail()
+	} else {
+		assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+		assert.Equal(t, "1", resp.Header.Get("Retry-After"))
+		resp.Body.Close()
+	}
+	assert.Equal(t, 1, dataBuffer.Len())
+}
+
+func Test_handleIntakeV2EventsBufferFullBlocks(t *testing.T) {
+	body := []byte(`{"metadata": {}}`)
+
+	// A full buffer with the block policy only holds the agent request up to the timeout
+	dataBuffer := NewAgentDataBuffer(1, 0, OverflowBlock)
+	dataBuffer.Add(AgentData{Data: body}, nil)
+	config := extensionConfig{
+		agentDataBlockTimeout: 50 * time.Millisecond,
+		intakeRetryAfter:      time.Second,
+	}
+
+	req := httptest.NewRequest("POST", "/intake/v2/events", bytes.NewReader(body))
+	recorder := httptest.NewRecorder()
+	start := time.Now()
+	handleIntakeV2Events(dataBuffer, &config)(recorder, req)
+
+	assert.Assert(t, time.Since(start) < time.Second)
+	assert.Equal(t, http.StatusServiceUnavailable, recorder.Code)
+	assert.Equal(t, "1", recorder.Header().Get("Retry-After"))
+	assert.Equal(t, 1, dataBuffer.Len())
+}
+
+type failingReader struct{}
+
+func (failingReader) Read([]byte) (int, error) {
+	return 0, errors.New("connection reset")
+}
+
+func Test_handleIntakeV2EventsUnreadableBody(t *testing.T) {
+	dataBuffer := NewAgentDataBuffer(100, 0, OverflowBlock)
+	config := extensionConfig{}
+
+	req := httptest.NewRequest("POST", "/intake/v2/events", failingReader{})
+	recorder := httptest.NewRecorder()
+	handleIntakeV2Events(dataBuffer, &config)(recorder, req)
+
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+	assert.Equal(t, `{"accepted":0,"errors":[{"message":"could not read request body: connection reset"}]}`, recorder.Body.String())
+	assert.Equal(t, 0, dataBuffer.Len())
+}
@@ -0,0 +1,206 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package extension
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+var errIntakeBodyTooLarge = errors.New("request body too large")
+
+// maxIntakeErrorDocumentBytes caps the rejected line echoed back to the agent
+const maxIntakeErrorDocumentBytes = 1024
+
+// intakeEventTypes are the top-level keys accepted on an intake v2 ndjson line
+var intakeEventTypes = map[string]bool{
+	"metadata":    true,
+	"transaction": true,
+	"span":        true,
+	"error":       true,
+	"metricset":   true,
+	"log":         true,
+}
+
+// sizeLimitedReader fails with errIntakeBodyTooLarge once more than the limit
+// has been read. A limit of 0 or less disables it. Errors reading the
+// underlying reader are kept, to tell them apart from errors of the consumer.
+type sizeLimitedReader struct {
+	reader    io.Reader
+	remaining int
+	exceeded  bool
+	readErr   error
+}
+
+func newSizeLimitedReader(reader io.Reader, limit int) *sizeLimitedReader {
+	if limit <= 0 {
+		return &sizeLimitedReader{reader: reader, remaining: -1}
+	}
+	return &sizeLimitedReader{reader: reader, remaining: limit}
+}
+
+func (l *sizeLimitedReader) Read(p []byte) (int, error) {
+	if l.remaining < 0 {
+		return l.read(p)
+	}
+	if l.exceeded {
+		return 0, errIntakeBodyTooLarge
+	}
+	// Read one byte past the limit to tell a body of exactly the limit apart
+	// from a larger one
+	if len(p) > l.remaining+1 {
+		p = p[:l.remaining+1]
+	}
+	n, err := l.read(p)
+	if n > l.remaining {
+		l.exceeded = true
+		return l.remaining, errIntakeBodyTooLarge
+	}
+	l.remaining -= n
+	return n, err
+}
+
+func (l *sizeLimitedReader) read(p []byte) (int, error) {
+	n, err := l.reader.Read(p)
+	if err != nil && err != io.EOF {
+		l.readErr = err
+	}
+	return n, err
+}
+
+// validateIntakeEvents checks that the agent data is an intake v2 ndjson body
+// starting with a metadata line, and returns an error for every rejected line.
+// Like the APM server, it keeps the valid events of a body with rejected
+// lines: it also returns the agent data made of the metadata and the accepted
+// events, uncompressed, along with the number of accepted events. Nothing is
+// accepted without valid metadata, as the events depend on it.
+func validateIntakeEvents(agentData AgentData) (AgentData, int, []IntakeEventError) {
+	data, err := decompressAgentData(agentData)
+	if err != nil {
+		return AgentData{}, 0, []IntakeEventError{{Message: err.Error()}}
+	}
+
+	var errs []IntakeEventError
+	var acceptedLines [][]byte
+	lineNumber := 0
+	sawFirstLine := false
+	sawMetadata := false
+	for len(data) > 0 {
+		lineNumber++
+		line := data
+		if lineEnd := bytes.IndexByte(data, '\n'); lineEnd >= 0 {
+			line, data = data[:lineEnd], data[lineEnd+1:]
+		} else {
+			data = nil
+		}
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+
+		eventType, err := intakeEventType(line)
+		if err == nil && !sawFirstLine && eventType != "metadata" {
+			err = errors.New("the first line must be metadata")
+		} else if err == nil && sawFirstLine && eventType == "metadata" {
+			err = errors.New("metadata is only allowed on the first line")
+		}
+		sawFirstLine = true
+		if err == nil {
+			sawMetadata = sawMetadata || eventType == "metadata"
+			acceptedLines = append(acceptedLines, line)
+		} else {
+			document := line
+			if len(document) > maxIntakeErrorDocumentBytes {
+				document = document[:maxIntakeErrorDocumentBytes]
+			}
+			errs = append(errs, IntakeEventError{
+				Message:  fmt.Sprintf("line %d: %v", lineNumber, err),
+				Document: string(document),
+			})
+		}
+	}
+
+	if !sawMetadata {
+		return AgentData{}, 0, errs
+	}
+	accepted := len(acceptedLines) - 1
+	if len(errs) == 0 {
+		return agentData, accepted, nil
+	}
+	if accepted == 0 {
+		return AgentData{}, 0, errs
+	}
+	return AgentData{Data: append(bytes.Join(acceptedLines, []byte("\n")), '\n')}, accepted, errs
+}
+
+// intakeEventType returns the type of the event held by the ndjson line
+func intakeEventType(line []byte) (string, error) {
+	var event map[string]json.RawMessage
+	if err := json.Unmarshal(line, &event); err != nil {
+		return "", fmt.Errorf("invalid JSON: %v", err)
+	}
+	if len(event) != 1 {
+		return "", fmt.Errorf("expected a single event, got %d top-level keys", len(event))
+	}
+	for eventType, value := range event {
+		if !intakeEventTypes[eventType] {
+			return "", fmt.Errorf("unknown event type %q", eventType)
+		}
+		if len(value) == 0 || value[0] != '{' {
+			return "", fmt.Errorf("%s must be a JSON object", eventType)
+		}
+		return eventType, nil
+	}
+	return "", nil
+}
+
+// rejectAgentData responds to the agent with an intake v2 error body
+func rejectAgentData(w http.ResponseWriter, r *http.Request, status int, errs []IntakeEventError) {
+	respondIntakeErrors(w, r, status, intakeResponse{Errors: errs})
+}
+
+// respondIntakeErrors responds to the agent with an intake v2 error body,
+// reporting the events that were accepted nonetheless
+func respondIntakeErrors(w http.ResponseWriter, r *http.Request, status int, response intakeResponse) {
+	log.Printf("Rejecting agent data with status %d: %d accepted, %d errors", status, response.Accepted, len(response.Errors))
+	body, err := json.Marshal(response)
+	if err != nil {
+		log.Printf("Could not encode intake errors: %v", err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(body)
+	signalAgentFlushed(r)
+}
+
+// setRetryAfter tells the agent when to send agent data again, in whole
+// seconds
+func setRetryAfter(w http.ResponseWriter, retryAfter time.Duration) {
+	seconds := int((retryAfter + time.Second - 1) / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+}
@@ -0,0 +1,139 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package extension
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+func TestValidateIntakeEvents(t *testing.T) {
+	tests := []struct {
+		name     string
+		body     string
+		accepted int
+		messages []string
+	}{
+		{"valid", "{\"metadata\": {}}\n{\"transaction\": {}}\n\n{\"log\": {}}\n", 2, nil},
+		{"metadata only", `{"metadata": {"service": {}}}`, 0, nil},
+		{"missing metadata", "{\"transaction\": {}}\n", 0, []string{"line 1: the first line must be metadata"}},
+		{"repeated metadata", "{\"metadata\": {}}\n{\"metadata\": {}}", 0, []string{"line 2: metadata is only allowed on the first line"}},
+		{"unknown event type", "{\"metadata\": {}}\n{\"foo\": {}}", 0, []string{"line 2: unknown event type \"foo\""}},
+		{"several events on a line", "{\"metadata\": {}}\n{\"span\": {}, \"error\": {}}", 0, []string{"line 2: expected a single event, got 2 top-level keys"}},
+		{"event is not an object", "{\"metadata\": {}}\n{\"span\": []}", 0, []string{"line 2: span must be a JSON object"}},
+		{"several rejected lines", "{\"metadata\": {}}\n{\"foo\": {}}\n{\"span\": {}}\nnot json", 1, []string{"line 2: unknown event type \"foo\"", "line 4: invalid JSON"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, accepted, errs := validateIntakeEvents(AgentData{Data: []byte(test.body)})
+			assert.Equal(t, test.accepted, accepted)
+			assert.Equal(t, len(test.messages), len(errs))
+			for i, message := range test.messages {
+				assert.Assert(t, strings.HasPrefix(errs[i].Message, message), errs[i].Message)
+				assert.Assert(t, errs[i].Document != "")
+			}
+		})
+	}
+}
+
+func TestValidateIntakeEventsUnsupportedEncoding(t *testing.T) {
+	_, _, errs := validateIntakeEvents(AgentData{Data: []byte(`{"metadata": {}}`), ContentEncoding: "br"})
+	assert.Equal(t, 1, len(errs))
+	assert.Equal(t, `unsupported content encoding "br"`, errs[0].Message)
+}
+
+func TestSizeLimitedReader(t *testing.T) {
+	data, err := ioutil.ReadAll(newSizeLimitedReader(strings.NewReader("12345"), 5))
+	assert.NilError(t, err)
+	assert.Equal(t, "12345", string(data))
+
+	limited := newSizeLimitedReader(strings.NewReader("123456"), 5)
+	_, err = ioutil.ReadAll(limited)
+	assert.Equal(t, errIntakeBodyTooLarge, err)
+	assert.Assert(t, limited.exceeded)
+
+	data, err = ioutil.ReadAll(newSizeLimitedReader(strings.NewReader("123456"), 0))
+	assert.NilError(t, err)
+	assert.Equal(t, "123456", string(data))
+}
+
+func Test_handleIntakeV2EventsRejectsInvalidEvents(t *testing.T) {
+	body := []byte("{\"metadata\": {}}\n{\"foo\": {}}\n")
+	dataBuffer := NewAgentDataBuffer(100, 0, OverflowBlock)
+	config := extensionConfig{}
+
+	req := httptest.NewRequest("POST", "/intake/v2/events", bytes.NewReader(body))
+	recorder := httptest.NewRecorder()
+	handleIntakeV2Events(dataBuffer, &config)(recorder, req)
+
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+	var response intakeResponse
+	assert.NilError(t, json.Unmarshal(recorder.Body.Bytes(), &response))
+	assert.Equal(t, 0, response.Accepted)
+	assert.DeepEqual(t, []IntakeEventError{{Message: `line 2: unknown event type "foo"`, Document: `{"foo": {}}`}}, response.Errors)
+	assert.Equal(t, 0, dataBuffer.Len())
+}
+
+func Test_handleIntakeV2EventsAcceptsValidEvents(t *testing.T) {
+	body := "{\"metadata\": {}}\n{\"transaction\": {}}\n{\"foo\": {}}\n{\"span\": {}}"
+	dataBuffer := NewAgentDataBuffer(100, 0, OverflowBlock)
+	config := extensionConfig{}
+
+	req := httptest.NewRequest("POST", "/intake/v2/events", bytes.NewReader(gzipAgentData(t, body).Data))
+	req.Header.Set("Content-Encoding", "gzip")
+	recorder := httptest.NewRecorder()
+	handleIntakeV2Events(dataBuffer, &config)(recorder, req)
+
+	// The valid events are buffered, and the agent is told about the rejected line
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+	var response intakeResponse
+	assert.NilError(t, json.Unmarshal(recorder.Body.Bytes(), &response))
+	assert.Equal(t, 2, response.Accepted)
+	assert.DeepEqual(t, []IntakeEventError{{Message: `line 3: unknown event type "foo"`, Document: `{"foo": {}}`}}, response.Errors)
+	assert.Equal(t, 1, dataBuffer.Len())
+	agentData, _ := dataBuffer.TryGet()
+	assert.Equal(t, "", agentData.ContentEncoding)
+	assert.Equal(t, "{\"metadata\": {}}\n{\"transaction\": {}}\n{\"span\": {}}\n", string(agentData.Data))
+}
+
+func Test_handleIntakeV2EventsRejectsLargeBody(t *testing.T) {
+	body := []byte("{\"metadata\": {}}\n{\"transaction\": {}}\n")
+	dataBuffer := NewAgentDataBuffer(100, 0, OverflowBlock)
+	config := extensionConfig{maxIntakeBodyBytes: 16}
+
+	// Without a content length, the limit applies while reading the body
+	req := httptest.NewRequest("POST", "/intake/v2/events", ioutil.NopCloser(bytes.NewReader(body)))
+	req.ContentLength = -1
+	recorder := httptest.NewRecorder()
+	handleIntakeV2Events(dataBuffer, &config)(recorder, req)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, recorder.Code)
+
+	req = httptest.NewRequest("POST", "/intake/v2/events", bytes.NewReader(body))
+	recorder = httptest.NewRecorder()
+	handleIntakeV2Events(dataBuffer, &config)(recorder, req)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, recorder.Code)
+	assert.Equal(t, `{"accepted":0,"errors":[{"message":"request body too large"}]}`, recorder.Body.String())
+	assert.Equal(t, 0, dataBuffer.Len())
+}
@@ -0,0 +1,195 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package extension
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Invocation holds the state of a function invocation, from the event
+// returned by the Next API until the extension is ready for the next event.
+// Its signals may be raised any number of times, from any goroutine, and
+// even after the invocation ended.
+type Invocation struct {
+	RequestID string
+	Deadline  time.Time
+
+	agentDone       chan struct{}
+	agentDoneOnce   sync.Once
+	flushedAgents   map[string]bool
+	flushedLock     sync.Mutex
+	runtimeDone     chan struct{}
+	runtimeDoneOnce sync.Once
+	done            chan struct{}
+	doneOnce        sync.Once
+}
+
+var currentInvocation struct {
+	sync.Mutex
+	invocation *Invocation
+}
+
+type invocationContextKey struct{}
+
+// StartInvocation creates the state of a new function invocation, and makes
+// it the one that agent requests are attributed to
+func StartInvocation(requestID string, deadline time.Time) *Invocation {
+	invocation := &Invocation{
+		RequestID:     requestID,
+		Deadline:      deadline,
+		agentDone:     make(chan struct{}),
+		flushedAgents: make(map[string]bool),
+		runtimeDone:   make(chan struct{}),
+		done:          make(chan struct{}),
+	}
+	currentInvocation.Lock()
+	currentInvocation.invocation = invocation
+	currentInvocation.Unlock()
+	return invocation
+}
+
+// CurrentInvocation returns the function invocation in progress, or nil
+// between invocations
+func CurrentInvocation() *Invocation {
+	currentInvocation.Lock()
+	defer currentInvocation.Unlock()
+	return currentInvocation.invocation
+}
+
+// AgentDone is closed when every registered agent flushed its data for the
+// invocation
+func (i *Invocation) AgentDone() <-chan struct{} {
+	return i.agentDone
+}
+
+// SignalAgentDone records that the agent flushed its data
+func (i *Invocation) SignalAgentDone(agentID string) {
+	i.flushedLock.Lock()
+	i.flushedAgents[agentID] = true
+	i.flushedLock.Unlock()
+	if len(i.PendingAgents()) == 0 {
+		i.agentDoneOnce.Do(func() { close(i.agentDone) })
+	}
+}
+
+// PendingAgents returns the registered agents that did not flush their data
+// for the invocation yet
+func (i *Invocation) PendingAgents() []string {
+	i.flushedLock.Lock()
+	defer i.flushedLock.Unlock()
+	var pending []string
+	for _, agentID := range registeredAgents.list() {
+		if !i.flushedAgents[agentID] {
+			pending = append(pending, agentID)
+		}
+	}
+	return pending
+}
+
+// RuntimeDone is closed when the Logs API reported the end of the invocation
+func (i *Invocation) RuntimeDone() <-chan struct{} {
+	return i.runtimeDone
+}
+
+// SignalRuntimeDone records that the Logs API reported the end of the
+// invocation
+func (i *Invocation) SignalRuntimeDone() {
+	i.runtimeDoneOnce.Do(func() { close(i.runtimeDone) })
+}
+
+// ReportPendingAgents logs the registered agents that did not flush their data
+// for the invocation
+func (i *Invocation) ReportPendingAgents() {
+	pending := i.PendingAgents()
+	if len(pending) == 0 {
+		return
+	}
+	names := make([]string, len(pending))
+	for j, agentID := range pending {
+		names[j] = describeAgent(agentID)
+	}
+	log.Printf("Invocation %s ended without a flush signal from: %s", i.RequestID, strings.Join(names, ", "))
+}
+
+// ExpireAgents stops waiting for the registered agents that did not signal a
+// flush in ELASTIC_APM_LAMBDA_AGENT_MAX_MISSED_FLUSHES invocations in a row,
+// as they may no longer exist
+func (i *Invocation) ExpireAgents(config *extensionConfig) {
+	registeredAgents.recordMissedFlushes(i.PendingAgents(), config.agentMaxMissedFlushes)
+}
+
+// Done is closed once the extension is done with the invocation
+func (i *Invocation) Done() <-chan struct{} {
+	return i.done
+}
+
+// End marks the invocation as done. Agent requests received from then on are
+// no longer attributed to it.
+func (i *Invocation) End() {
+	i.doneOnce.Do(func() { close(i.done) })
+	currentInvocation.Lock()
+	if currentInvocation.invocation == i {
+		currentInvocation.invocation = nil
+	}
+	currentInvocation.Unlock()
+}
+
+// withInvocation registers the agent sending the request, and attributes the
+// request to the function invocation in progress when it is received, so that
+// late requests can not signal a later invocation
+func withInvocation(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if registeredAgents.register(agentID(r), isFlushSignal(r)) {
+			log.Printf("Registered %s", describeAgent(agentID(r)))
+		}
+		if invocation := CurrentInvocation(); invocation != nil {
+			r = r.WithContext(context.WithValue(r.Context(), invocationContextKey{}, invocation))
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// signalAgentFlushed lets the main loop know that the agent flushed its data
+// at the end of the invocation
+func signalAgentFlushed(r *http.Request) {
+	if !isFlushSignal(r) {
+		return
+	}
+	invocation, ok := r.Context().Value(invocationContextKey{}).(*Invocation)
+	if !ok {
+		log.Printf("Ignoring flush signal from %s received outside of a function invocation", describeAgent(agentID(r)))
+		return
+	}
+	select {
+	case <-invocation.Done():
+		log.Printf("Ignoring late flush signal from %s for invocation %s", describeAgent(agentID(r)), invocation.RequestID)
+	default:
+		log.Printf("Received flush signal from %s", describeAgent(agentID(r)))
+		invocation.SignalAgentDone(agentID(r))
+	}
+}
+
+// isFlushSignal reports whether the agent flushed its data with the request
+func isFlushSignal(r *http.Request) bool {
+	return len(r.URL.Query()["flushed"]) > 0 && r.URL.Query()["flushed"][0] == "true"
+}
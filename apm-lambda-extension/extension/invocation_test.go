@@ -0,0 +1,180 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package extension
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+)
+
+func TestInvocationSignalsAreIdempotent(t *testing.T) {
+	defer func() { registeredAgents = newAgentRegistry() }()
+	invocation := StartInvocation("test-request", time.Now().Add(time.Minute))
+	defer invocation.End()
+	assert.Equal(t, invocation, CurrentInvocation())
+
+	invocation.SignalAgentDone("")
+	invocation.SignalAgentDone("")
+	invocation.SignalRuntimeDone()
+	invocation.SignalRuntimeDone()
+	<-invocation.AgentDone()
+	<-invocation.RuntimeDone()
+
+	invocation.End()
+	invocation.End()
+	<-invocation.Done()
+	assert.Assert(t, CurrentInvocation() == nil)
+}
+
+func TestFlushSignalsAreAttributedToTheirInvocation(t *testing.T) {
+	defer func() { registeredAgents = newAgentRegistry() }()
+	handled := make(chan struct{})
+	release := make(chan struct{})
+	handler := withInvocation(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(handled)
+		<-release
+		signalAgentFlushed(r)
+	}))
+
+	// The flush request is received during the first invocation, and only
+	// handled once the next invocation started
+	first := StartInvocation("first-request", time.Now().Add(time.Minute))
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/intake/v2/events?flushed=true", nil))
+	}()
+	<-handled
+	first.End()
+	second := StartInvocation("second-request", time.Now().Add(time.Minute))
+	defer second.End()
+	close(release)
+	<-done
+
+	select {
+	case <-second.AgentDone():
+		t.Fatal("late flush signal was attributed to the next invocation")
+	case <-first.AgentDone():
+		t.Fatal("late flush signal was delivered to an ended invocation")
+	default:
+	}
+}
+
+func TestFlushSignalOutsideOfInvocation(t *testing.T) {
+	defer func() { registeredAgents = newAgentRegistry() }()
+	handler := withInvocation(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		signalAgentFlushed(r)
+	}))
+	// Must neither block nor panic
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/intake/v2/events?flushed=true", nil))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/intake/v2/events?flushed=true", nil))
+}
+
+func TestInvocationWaitsForEveryAgent(t *testing.T) {
+	defer func() { registeredAgents = newAgentRegistry() }()
+	handler := withInvocation(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		signalAgentFlushed(r)
+	}))
+	request := func(agentID string, flushed bool) *http.Request {
+		url := "/intake/v2/events"
+		if flushed {
+			url += "?flushed=true"
+		}
+		r := httptest.NewRequest("POST", url, nil)
+		if agentID != "" {
+			r.Header.Set(AgentIDHeader, agentID)
+		}
+		return r
+	}
+
+	// Both agents register during the first invocation
+	first := StartInvocation("first-request", time.Now().Add(time.Minute))
+	handler.ServeHTTP(httptest.NewRecorder(), request("node", false))
+	handler.ServeHTTP(httptest.NewRecorder(), request("python", true))
+	assert.DeepEqual(t, []string{"node"}, first.PendingAgents())
+	handler.ServeHTTP(httptest.NewRecorder(), request("node", true))
+	<-first.AgentDone()
+	first.End()
+
+	// Registered agents are waited for in the next invocations, even before
+	// they send any request
+	second := StartInvocation("second-request", time.Now().Add(time.Minute))
+	defer second.End()
+	handler.ServeHTTP(httptest.NewRecorder(), request("node", true))
+	select {
+	case <-second.AgentDone():
+		t.Fatal("invocation done before every agent flushed")
+	default:
+	}
+	assert.DeepEqual(t, []string{"python"}, second.PendingAgents())
+
+	// An agent that does not identify itself is waited for as well
+	handler.ServeHTTP(httptest.NewRecorder(), request("", false))
+	handler.ServeHTTP(httptest.NewRecorder(), request("python", true))
+	assert.DeepEqual(t, []string{""}, second.PendingAgents())
+	handler.ServeHTTP(httptest.NewRecorder(), request("", true))
+	<-second.AgentDone()
+}
+
+func TestAgentsExpireAfterMissedFlushes(t *testing.T) {
+	defer func() { registeredAgents = newAgentRegistry() }()
+	config := extensionConfig{agentMaxMissedFlushes: 2}
+	handler := withInvocation(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		signalAgentFlushed(r)
+	}))
+	request := func(flushed bool) *http.Request {
+		url := "/intake/v2/events"
+		if flushed {
+			url += "?flushed=true"
+		}
+		r := httptest.NewRequest("POST", url, nil)
+		r.Header.Set(AgentIDHeader, "python")
+		return r
+	}
+	invoke := func(requestID string, requests ...*http.Request) *Invocation {
+		invocation := StartInvocation(requestID, time.Now().Add(time.Minute))
+		for _, r := range requests {
+			handler.ServeHTTP(httptest.NewRecorder(), r)
+		}
+		invocation.ExpireAgents(&config)
+		invocation.End()
+		return invocation
+	}
+
+	// A flush resets the count of missed flushes
+	invoke("first", request(false))
+	invoke("second", request(true))
+	invoke("third")
+	assert.DeepEqual(t, []string{"python"}, registeredAgents.list())
+
+	// The agent expires after missing two flushes in a row, and is not
+	// registered again by requests without a flush signal
+	invoke("fourth")
+	assert.Equal(t, 0, len(registeredAgents.list()))
+	invoke("fifth", request(false))
+	assert.Equal(t, 0, len(registeredAgents.list()))
+
+	// A flush signal registers the agent again
+	invocation := invoke("sixth", request(true))
+	assert.DeepEqual(t, []string{"python"}, registeredAgents.list())
+	assert.Equal(t, 0, len(invocation.PendingAgents()))
+}
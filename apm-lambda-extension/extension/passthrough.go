@@ -0,0 +1,194 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package extension
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+)
+
+// retainedPrefix keeps the first bytes written to it, up to a limit, and
+// discards the rest
+type retainedPrefix struct {
+	bytes.Buffer
+	limit     int
+	truncated bool
+}
+
+func (p *retainedPrefix) Write(data []byte) (int, error) {
+	if room := p.limit - p.Len(); room < len(data) {
+		p.truncated = true
+		if room > 0 {
+			p.Buffer.Write(data[:room])
+		}
+		return len(data), nil
+	}
+	return p.Buffer.Write(data)
+}
+
+// URL: http://server/intake/v2/events
+//
+// handleIntakeV2EventsPassthrough pipes the agent request body straight into
+// an intake request to the APM server, so that agent data is never held in
+// memory as a whole. Only the start of the body is retained, so that the agent
+// data can still be buffered if the APM server turns out to be unreachable.
+// When the APM server is known to be unavailable or throttling requests, or
+// spooled agent data waits to be replayed ahead of it, the agent data goes to
+// the buffer right away. The body size is limited, but ndjson lines are not
+// validated while passing them through, the APM server does that. They are
+// only validated when the agent data ends up in the buffer.
+func handleIntakeV2EventsPassthrough(client *http.Client, agentDataBuffer *AgentDataBuffer, config *extensionConfig) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+		if config.maxIntakeBodyBytes > 0 && r.ContentLength > int64(config.maxIntakeBodyBytes) {
+			rejectAgentData(w, r, http.StatusRequestEntityTooLarge, []IntakeEventError{{Message: errIntakeBodyTooLarge.Error()}})
+			return
+		}
+		limitedBody := newSizeLimitedReader(r.Body, config.maxIntakeBodyBytes)
+
+		var prefix []byte
+		destination := primaryDestination(config)
+		if !spoolPending() && destination.limiter.tryAcquire() &&
+			destination.breaker.allow(config.circuitBreakerThreshold, config.circuitBreakerCooldown) {
+			retained := &retainedPrefix{limit: config.passthroughRetainBytes}
+			body := io.TeeReader(limitedBody, retained)
+			err := forwardAgentData(r.Context(), client, destination, body, r.Header.Get("Content-Encoding"))
+			// The intake request was aborted by the extension, the APM
+			// server is not to blame, but a probe request is given up
+			if limitedBody.exceeded {
+				destination.breaker.releaseProbe()
+				rejectAgentData(w, r, http.StatusRequestEntityTooLarge, []IntakeEventError{{Message: errIntakeBodyTooLarge.Error()}})
+				return
+			}
+			if limitedBody.readErr != nil {
+				destination.breaker.releaseProbe()
+				log.Printf("Could not read bytes from agent request body: %v", limitedBody.readErr)
+				rejectAgentData(w, r, http.StatusBadRequest, []IntakeEventError{{Message: "could not read request body: " + limitedBody.readErr.Error()}})
+				return
+			}
+			destination.limiter.observe(err, config.rateLimitStep, config.rateLimitMaxInterval)
+
+			if err == nil || !IsRetryable(err) {
+				destination.breaker.recordSuccess()
+				apmServerEndpoints.markHealthy(destination.url)
+				var apmServerErr *ApmServerError
+				if errors.As(err, &apmServerErr) {
+					log.Printf("APM server rejected agent data, dropping it: %v", err)
+					errs := apmServerErr.Errors
+					if len(errs) == 0 {
+						errs = []IntakeEventError{{Message: apmServerErr.Error()}}
+					}
+					respondIntakeErrors(w, r, apmServerErr.StatusCode, intakeResponse{Accepted: apmServerErr.Accepted, Errors: errs})
+					return
+				}
+				w.WriteHeader(http.StatusAccepted)
+				w.Write([]byte("ok"))
+				signalAgentFlushed(r)
+				return
+			}
+
+			if isThrottled(err) || r.Context().Err() != nil {
+				destination.breaker.releaseProbe()
+			} else {
+				destination.breaker.recordFailure(config.circuitBreakerThreshold)
+				apmServerEndpoints.markFailing(destination.url)
+			}
+			if retained.truncated {
+				log.Printf("Error streaming agent data to APM server after %d bytes, dropping it: %v", config.passthroughRetainBytes, err)
+				retryAfter := config.intakeRetryAfter
+				var apmServerErr *ApmServerError
+				if errors.As(err, &apmServerErr) && apmServerErr.RetryAfter > retryAfter {
+					retryAfter = apmServerErr.RetryAfter
+				}
+				setRetryAfter(w, retryAfter)
+				rejectAgentData(w, r, http.StatusServiceUnavailable, []IntakeEventError{{Message: "APM server unavailable: " + err.Error()}})
+				return
+			}
+			log.Printf("Error streaming agent data to APM server, buffering it: %v", err)
+			prefix = retained.Bytes()
+		}
+
+		rest, err := ioutil.ReadAll(limitedBody)
+		if err == errIntakeBodyTooLarge {
+			rejectAgentData(w, r, http.StatusRequestEntityTooLarge, []IntakeEventError{{Message: err.Error()}})
+			return
+		}
+		if err != nil {
+			log.Printf("Could not read bytes from agent request body: %v", err)
+			rejectAgentData(w, r, http.StatusBadRequest, []IntakeEventError{{Message: "could not read request body: " + err.Error()}})
+			return
+		}
+		validateAndBufferAgentData(w, r, agentDataBuffer, append(prefix, rest...), config)
+	}
+}
+
+// forwardAgentData streams the agent data to the APM server. Agent data that
+// is not compressed yet is gzipped on the way, while compressed agent data is
+// sent as is.
+func forwardAgentData(ctx context.Context, client *http.Client, destination *apmServerDestination, body io.Reader, encoding string) error {
+	pipeReader, pipeWriter := io.Pipe()
+	req, err := http.NewRequestWithContext(ctx, "POST", destination.url+"intake/v2/events", pipeReader)
+	if err != nil {
+		return fmt.Errorf("failed to create a new request when streaming to APM server: %v", err)
+	}
+	if encoding == "" {
+		req.Header.Add("Content-Encoding", "gzip")
+	} else {
+		req.Header.Add("Content-Encoding", encoding)
+	}
+	req.Header.Add("Content-Type", "application/x-ndjson")
+	setAuthorizationHeader(req, destination, nil)
+
+	copied := make(chan struct{})
+	go func() {
+		defer close(copied)
+		var err error
+		if encoding == "" {
+			gzipWriter, _ := gzip.NewWriterLevel(pipeWriter, gzip.BestSpeed)
+			if _, err = io.Copy(gzipWriter, body); err == nil {
+				err = gzipWriter.Close()
+			}
+		} else {
+			_, err = io.Copy(pipeWriter, body)
+		}
+		pipeWriter.CloseWithError(err)
+	}()
+
+	resp, err := client.Do(req)
+	// Unblock the copy, the APM server does not read the request anymore, and
+	// wait for it so that the body is not read concurrently by the caller
+	pipeReader.Close()
+	<-copied
+	if err != nil {
+		return fmt.Errorf("failed to stream to APM server: %v", err)
+	}
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read the response body after streaming to the APM server")
+	}
+	log.Printf("APM server response status code: %v\n", resp.StatusCode)
+	return checkApmServerResponse(resp, respBody)
+}
@@ -0,0 +1,219 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package extension
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+)
+
+func TestPassthroughStreamsAgentData(t *testing.T) {
+	defer func() { apmServerEndpoints = newEndpointPool() }()
+	body := []byte("{\"metadata\": {}}\n{\"transaction\": {}}\n")
+
+	var received []byte
+	apmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "gzip", r.Header.Get("Content-Encoding"))
+		assert.Equal(t, "Bearer foo", r.Header.Get("Authorization"))
+		gzipReader, err := gzip.NewReader(r.Body)
+		assert.NilError(t, err)
+		received, _ = ioutil.ReadAll(gzipReader)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer apmServer.Close()
+
+	dataBuffer := NewAgentDataBuffer(100, 0, OverflowBlock)
+	config := extensionConfig{
+		apmServerUrl:           apmServer.URL + "/",
+		apmServerSecretToken:   "foo",
+		passthroughRetainBytes: 8,
+	}
+
+	req := httptest.NewRequest("POST", "/intake/v2/events", bytes.NewReader(body))
+	recorder := httptest.NewRecorder()
+	handleIntakeV2EventsPassthrough(apmServer.Client(), dataBuffer, &config)(recorder, req)
+
+	assert.Equal(t, http.StatusAccepted, recorder.Code)
+	assert.DeepEqual(t, body, received)
+	assert.Equal(t, 0, dataBuffer.Len())
+}
+
+func TestPassthroughBuffersAgentDataOnFailure(t *testing.T) {
+	defer func() { apmServerEndpoints = newEndpointPool() }()
+	var body bytes.Buffer
+	zlibWriter := zlib.NewWriter(&body)
+	zlibWriter.Write([]byte("{\"metadata\": {}}\n{\"transaction\": {}}\n"))
+	zlibWriter.Close()
+
+	apmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer apmServer.Close()
+
+	dataBuffer := NewAgentDataBuffer(100, 0, OverflowBlock)
+	config := extensionConfig{
+		apmServerUrl:           apmServer.URL + "/",
+		passthroughRetainBytes: 1024,
+	}
+
+	req := httptest.NewRequest("POST", "/intake/v2/events", bytes.NewReader(body.Bytes()))
+	req.Header.Set("Content-Encoding", "deflate")
+	recorder := httptest.NewRecorder()
+	handleIntakeV2EventsPassthrough(apmServer.Client(), dataBuffer, &config)(recorder, req)
+
+	assert.Equal(t, http.StatusAccepted, recorder.Code)
+	assert.Equal(t, 1, dataBuffer.Len())
+	agentData, _ := dataBuffer.TryGet()
+	assert.DeepEqual(t, body.Bytes(), agentData.Data)
+	assert.Equal(t, "deflate", agentData.ContentEncoding)
+}
+
+func TestPassthroughDropsAgentDataBeyondRetainedBytes(t *testing.T) {
+	defer func() { apmServerEndpoints = newEndpointPool() }()
+	body := bytes.Repeat([]byte("{\"transaction\": {}}\n"), 1000)
+
+	apmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer apmServer.Close()
+
+	dataBuffer := NewAgentDataBuffer(100, 0, OverflowBlock)
+	config := extensionConfig{
+		apmServerUrl:           apmServer.URL + "/",
+		passthroughRetainBytes: 64,
+		intakeRetryAfter:       2 * time.Second,
+	}
+
+	req := httptest.NewRequest("POST", "/intake/v2/events", bytes.NewReader(body))
+	recorder := httptest.NewRecorder()
+	handleIntakeV2EventsPassthrough(apmServer.Client(), dataBuffer, &config)(recorder, req)
+
+	assert.Equal(t, http.StatusServiceUnavailable, recorder.Code)
+	assert.Equal(t, "2", recorder.Header().Get("Retry-After"))
+	assert.Equal(t, 0, dataBuffer.Len())
+}
+
+func TestPassthroughRelaysRejectedAgentData(t *testing.T) {
+	defer func() { apmServerEndpoints = newEndpointPool() }()
+	body := []byte("{\"metadata\": {}}\n{\"transaction\": {}}\n")
+
+	apmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"accepted": 1, "errors": [{"message": "invalid transaction"}]}`))
+	}))
+	defer apmServer.Close()
+
+	dataBuffer := NewAgentDataBuffer(100, 0, OverflowBlock)
+	config := extensionConfig{apmServerUrl: apmServer.URL + "/"}
+
+	req := httptest.NewRequest("POST", "/intake/v2/events", bytes.NewReader(body))
+	recorder := httptest.NewRecorder()
+	handleIntakeV2EventsPassthrough(apmServer.Client(), dataBuffer, &config)(recorder, req)
+
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+	assert.Equal(t, `{"accepted":1,"errors":[{"message":"invalid transaction"}]}`, recorder.Body.String())
+	assert.Equal(t, 0, dataBuffer.Len())
+}
+
+func TestRetainedPrefix(t *testing.T) {
+	retained := &retainedPrefix{limit: 5}
+	n, err := retained.Write([]byte("abc"))
+	assert.NilError(t, err)
+	assert.Equal(t, 3, n)
+	assert.Assert(t, !retained.truncated)
+
+	n, err = retained.Write([]byte("defg"))
+	assert.NilError(t, err)
+	assert.Equal(t, 4, n)
+	assert.Assert(t, retained.truncated)
+	assert.Equal(t, "abcde", retained.String())
+}
+
+func TestPassthroughRejectsLargeBody(t *testing.T) {
+	defer func() { apmServerEndpoints = newEndpointPool() }()
+	body := bytes.Repeat([]byte("{\"transaction\": {}}\n"), 1000)
+
+	apmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer apmServer.Close()
+
+	dataBuffer := NewAgentDataBuffer(100, 0, OverflowBlock)
+	config := extensionConfig{
+		apmServerUrl:            apmServer.URL + "/",
+		passthroughRetainBytes:  64,
+		maxIntakeBodyBytes:      1024,
+		circuitBreakerThreshold: 1,
+	}
+
+	req := httptest.NewRequest("POST", "/intake/v2/events", ioutil.NopCloser(bytes.NewReader(body)))
+	req.ContentLength = -1
+	recorder := httptest.NewRecorder()
+	handleIntakeV2EventsPassthrough(apmServer.Client(), dataBuffer, &config)(recorder, req)
+
+	assert.Equal(t, http.StatusRequestEntityTooLarge, recorder.Code)
+	assert.Equal(t, 0, dataBuffer.Len())
+	// The APM server is not held responsible for the aborted request
+	assert.Assert(t, primaryDestination(&config).breaker.allow(config.circuitBreakerThreshold, time.Minute))
+}
+
+func TestPassthroughReleasesProbeForLargeBody(t *testing.T) {
+	defer func() { apmServerEndpoints = newEndpointPool() }()
+	body := bytes.Repeat([]byte("{\"transaction\": {}}\n"), 1000)
+
+	apmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer apmServer.Close()
+
+	config := extensionConfig{
+		apmServerUrl:            apmServer.URL + "/",
+		passthroughRetainBytes:  64,
+		maxIntakeBodyBytes:      1024,
+		circuitBreakerThreshold: 1,
+		circuitBreakerCooldown:  time.Millisecond,
+	}
+
+	// Let the cooldown elapse, the agent request is the probe request
+	breaker := primaryDestination(&config).breaker
+	breaker.recordFailure(config.circuitBreakerThreshold)
+	time.Sleep(10 * time.Millisecond)
+
+	req := httptest.NewRequest("POST", "/intake/v2/events", ioutil.NopCloser(bytes.NewReader(body)))
+	req.ContentLength = -1
+	recorder := httptest.NewRecorder()
+	handleIntakeV2EventsPassthrough(apmServer.Client(), NewAgentDataBuffer(100, 0, OverflowBlock), &config)(recorder, req)
+
+	assert.Equal(t, http.StatusRequestEntityTooLarge, recorder.Code)
+	// The breaker is not stuck half-open, the next request probes again
+	assert.Equal(t, circuitOpen, breaker.currentState())
+	assert.Assert(t, breaker.allow(config.circuitBreakerThreshold, config.circuitBreakerCooldown))
+}
@@ -0,0 +1,100 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package extension
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+
+	"elastic/apm-lambda-extension/logsapi"
+)
+
+// PlatformMetricsReporter turns the platform.report events received from the
+// Logs API into intake v2 metricsets, one per invocation, and adds them to
+// the agent data buffer
+type PlatformMetricsReporter struct {
+	agentDataBuffer *AgentDataBuffer
+	metadata        []byte
+	functionName    string
+	functionVersion string
+}
+
+type metricsetEvent struct {
+	Metricset metricset `json:"metricset"`
+}
+
+type metricset struct {
+	Timestamp int64                      `json:"timestamp"`
+	Tags      map[string]string          `json:"tags"`
+	Samples   map[string]metricsetSample `json:"samples"`
+}
+
+type metricsetSample struct {
+	Value float64 `json:"value"`
+}
+
+// NewPlatformMetricsReporter returns a reporter adding metricsets to the buffer
+func NewPlatformMetricsReporter(agentDataBuffer *AgentDataBuffer) *PlatformMetricsReporter {
+	return &PlatformMetricsReporter{
+		agentDataBuffer: agentDataBuffer,
+		metadata:        functionMetadata(),
+		functionName:    os.Getenv("AWS_LAMBDA_FUNCTION_NAME"),
+		functionVersion: os.Getenv("AWS_LAMBDA_FUNCTION_VERSION"),
+	}
+}
+
+// Process handles an event from the Logs API, and reports the metrics of
+// platform.report events
+func (p *PlatformMetricsReporter) Process(logEvent logsapi.LogEvent) {
+	if logsapi.SubEventType(logEvent.Type) != logsapi.PlatformReport {
+		return
+	}
+	data, err := json.Marshal(p.metricset(logEvent))
+	if err != nil {
+		log.Printf("Could not encode platform metrics: %v", err)
+		return
+	}
+	payload := make([]byte, 0, len(p.metadata)+len(data)+1)
+	payload = append(append(append(payload, p.metadata...), data...), '\n')
+	bufferLogsAPIData(p.agentDataBuffer, payload, "platform metrics")
+}
+
+// metricset converts the metrics of the invocation, durations are in
+// milliseconds and memory in bytes
+func (p *PlatformMetricsReporter) metricset(logEvent logsapi.LogEvent) metricsetEvent {
+	metrics := logEvent.Record.Metrics
+	samples := map[string]metricsetSample{
+		"faas.duration":             {Value: metrics.DurationMs},
+		"faas.billed_duration":      {Value: float64(metrics.BilledDurationMs)},
+		"system.memory.total":       {Value: float64(metrics.MemorySizeMB) * 1024 * 1024},
+		"system.memory.actual.free": {Value: float64(metrics.MemorySizeMB-metrics.MaxMemoryUsedMB) * 1024 * 1024},
+	}
+	if metrics.InitDurationMs > 0 {
+		samples["faas.coldstart_duration"] = metricsetSample{Value: metrics.InitDurationMs}
+	}
+	return metricsetEvent{Metricset: metricset{
+		Timestamp: logEvent.Time.UnixNano() / 1000,
+		Tags: map[string]string{
+			"faas_name":      p.functionName,
+			"faas_version":   p.functionVersion,
+			"faas_execution": logEvent.Record.RequestId,
+		},
+		Samples: samples,
+	}}
+}
@@ -0,0 +1,85 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package extension
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"testing"
+
+	"elastic/apm-lambda-extension/logsapi"
+
+	"gotest.tools/assert"
+)
+
+func TestPlatformMetricsReporter(t *testing.T) {
+	os.Setenv("AWS_LAMBDA_FUNCTION_NAME", "test-function")
+	os.Setenv("AWS_LAMBDA_FUNCTION_VERSION", "$LATEST")
+	defer os.Unsetenv("AWS_LAMBDA_FUNCTION_NAME")
+	defer os.Unsetenv("AWS_LAMBDA_FUNCTION_VERSION")
+
+	dataBuffer := NewAgentDataBuffer(100, 0, OverflowBlock)
+	reporter := NewPlatformMetricsReporter(dataBuffer)
+
+	reporter.Process(newLogEvent("platform.start", "test-request", `{"requestId": "test-request"}`))
+	assert.Equal(t, 0, dataBuffer.Len())
+
+	report := newLogEvent("platform.report", "test-request", `{}`)
+	report.Record.Metrics = logsapi.PlatformMetrics{
+		DurationMs:       101.5,
+		BilledDurationMs: 102,
+		MemorySizeMB:     128,
+		MaxMemoryUsedMB:  32,
+	}
+	reporter.Process(report)
+	assert.Equal(t, 1, dataBuffer.Len())
+
+	agentData, _ := dataBuffer.TryGet()
+	_, _, errs := validateIntakeEvents(agentData)
+	assert.Assert(t, len(errs) == 0)
+	lines := bytes.Split(bytes.TrimSpace(agentData.Data), []byte("\n"))
+	assert.Equal(t, 2, len(lines))
+
+	var event metricsetEvent
+	assert.NilError(t, json.Unmarshal(lines[1], &event))
+	assert.DeepEqual(t, metricsetEvent{Metricset: metricset{
+		Timestamp: 1634717583278000,
+		Tags: map[string]string{
+			"faas_name":      "test-function",
+			"faas_version":   "$LATEST",
+			"faas_execution": "test-request",
+		},
+		Samples: map[string]metricsetSample{
+			"faas.duration":             {Value: 101.5},
+			"faas.billed_duration":      {Value: 102},
+			"system.memory.total":       {Value: 128 * 1024 * 1024},
+			"system.memory.actual.free": {Value: 96 * 1024 * 1024},
+		},
+	}}, event)
+}
+
+func TestPlatformMetricsReporterColdStart(t *testing.T) {
+	dataBuffer := NewAgentDataBuffer(100, 0, OverflowBlock)
+	reporter := NewPlatformMetricsReporter(dataBuffer)
+
+	report := newLogEvent("platform.report", "test-request", `{}`)
+	report.Record.Metrics = logsapi.PlatformMetrics{InitDurationMs: 116.67}
+	event := reporter.metricset(report)
+	assert.Equal(t, 116.67, event.Metricset.Samples["faas.coldstart_duration"].Value)
+}
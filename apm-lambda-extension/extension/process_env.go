@@ -18,19 +18,77 @@
 package extension
 
 import (
+	"fmt"
 	"log"
 	"os"
 	"strconv"
 	"strings"
+	"time"
+
+	"elastic/apm-lambda-extension/logsapi"
 )
 
 type extensionConfig struct {
 	apmServerUrl               string
+	apmServerUrls              []string
+	failoverCooldown           time.Duration
+	rateLimitStep              time.Duration
+	rateLimitMaxInterval       time.Duration
 	apmServerSecretToken       string
 	apmServerApiKey            string
+	secretTokenSecretArn       string
+	secretTokenParameter       string
+	apiKeySecretArn            string
+	apiKeyParameter            string
+	secretsManagerEndpoint     string
+	ssmEndpoint                string
+	awsRegion                  string
+	credentials                *credentialManager
+	sigV4Signer                *sigV4Signer
+	credentialRefreshInterval  time.Duration
 	dataReceiverServerPort     string
 	SendStrategy               SendStrategy
+	FlushDeadlineMargin        time.Duration
+	StreamAgentData            bool
+	passthroughAgentData       bool
+	SendFunctionLogs           bool
+	SendPlatformMetrics        bool
+	SubscriptionAPI            logsapi.SubscriptionAPI
+	SubscriptionTypes          []logsapi.EventType
+	SubscriptionBuffering      logsapi.BufferingCfg
+	LogsListenerProtocol       logsapi.HttpProtocol
+	passthroughRetainBytes     int
+	maxIntakeBodyBytes         int
+	intakeRetryAfter           time.Duration
 	dataReceiverTimeoutSeconds int
+	apmServerMaxRetries        int
+	apmServerRetryBackoff      time.Duration
+	apmServerRetryMaxBackoff   time.Duration
+	circuitBreakerThreshold    int
+	circuitBreakerCooldown     time.Duration
+	spoolDir                   string
+	spoolMaxBytes              int64
+	batchMaxBytes              int
+	batchMaxPayloads           int
+	AgentDataBufferSize        int
+	AgentDataBufferBytes       int
+	AgentDataBufferOverflow    OverflowPolicy
+	agentDataBlockTimeout      time.Duration
+	agentMaxMissedFlushes      int
+	AgentFlushGracePeriod      time.Duration
+	secondaryDestinations      []SecondaryDestinationConfig
+	secondarySendTimeout       time.Duration
+	secondaryGracePeriod       time.Duration
+	tlsCACert                  string
+	tlsClientCert              string
+	tlsClientKey               string
+	tlsMinVersion              string
+	tlsVerifyServerCert        bool
+	proxyURL                   string
+	proxyUsername              string
+	proxyPassword              string
+	noProxy                    []string
+	useFunctionProxy           bool
 }
 
 // SendStrategy represents the type of sending strategy the extension uses
@@ -56,6 +114,72 @@ func getIntFromEnv(name string) (int, error) {
 	return value, nil
 }
 
+// getIntFromEnvOrDefault reads a non-negative integer from the environment,
+// or returns the default value if it is not set. Like the other numeric
+// settings, an invalid value stops the extension rather than being replaced
+// by the default.
+func getIntFromEnvOrDefault(name string, defaultValue int) int {
+	value, err := readIntFromEnvOrDefault(name, defaultValue)
+	if err != nil {
+		log.Fatalf("Invalid %s, exiting: %v", name, err)
+	}
+	return value
+}
+
+// readIntFromEnvOrDefault reads a non-negative integer from the environment,
+// or returns the default value if it is not set
+func readIntFromEnvOrDefault(name string, defaultValue int) (int, error) {
+	strValue := os.Getenv(name)
+	if strValue == "" {
+		return defaultValue, nil
+	}
+	value, err := strconv.Atoi(strValue)
+	if err != nil {
+		return 0, fmt.Errorf("could not read %s: %v", name, err)
+	}
+	if value < 0 {
+		return 0, fmt.Errorf("%s must not be negative, got %d", name, value)
+	}
+	return value, nil
+}
+
+// getUint32FromEnvOrDefault reads an unsigned 32 bit integer from the
+// environment, or returns the default value if it is not set
+func getUint32FromEnvOrDefault(name string, defaultValue uint32) (uint32, error) {
+	strValue := os.Getenv(name)
+	if strValue == "" {
+		return defaultValue, nil
+	}
+	value, err := strconv.ParseUint(strValue, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("could not read %s: %v", name, err)
+	}
+	return uint32(value), nil
+}
+
+// getStringFromEnvOrDefault reads a string from the environment, or returns the
+// default value if it is not set
+func getStringFromEnvOrDefault(name string, defaultValue string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return defaultValue
+}
+
+// getBoolFromEnv reads a boolean from the environment, defaulting to false
+func getBoolFromEnv(name string) bool {
+	strValue := os.Getenv(name)
+	if strValue == "" {
+		return false
+	}
+	value, err := strconv.ParseBool(strValue)
+	if err != nil {
+		log.Printf("Could not read %s, defaulting to false: %v\n", name, err)
+		return false
+	}
+	return value
+}
+
 // pull env into globals
 func ProcessEnv() *extensionConfig {
 	dataReceiverTimeoutSeconds, err := getIntFromEnv("ELASTIC_APM_DATA_RECEIVER_TIMEOUT_SECONDS")
@@ -64,10 +188,41 @@ func ProcessEnv() *extensionConfig {
 		dataReceiverTimeoutSeconds = 15
 	}
 
-	// add trailing slash to server name if missing
-	normalizedApmLambdaServer := os.Getenv("ELASTIC_APM_LAMBDA_APM_SERVER")
-	if normalizedApmLambdaServer != "" && normalizedApmLambdaServer[len(normalizedApmLambdaServer)-1:] != "/" {
-		normalizedApmLambdaServer = normalizedApmLambdaServer + "/"
+	// split the list of servers to fail over to, adding trailing slashes to server names if missing
+	apmServerUrls := parseApmServerUrls(os.Getenv("ELASTIC_APM_LAMBDA_APM_SERVER"))
+	normalizedApmLambdaServer := ""
+	if len(apmServerUrls) > 0 {
+		normalizedApmLambdaServer = apmServerUrls[0]
+	}
+
+	// Get the agent data buffer overflow policy, convert to lowercase
+	normalizedOverflowPolicy := OverflowBlock
+	switch overflowPolicy := OverflowPolicy(strings.ToLower(os.Getenv("ELASTIC_APM_LAMBDA_AGENT_DATA_BUFFER_OVERFLOW"))); overflowPolicy {
+	case OverflowDropNewest, OverflowDropOldest, OverflowReject:
+		normalizedOverflowPolicy = overflowPolicy
+	case "", OverflowBlock:
+	default:
+		log.Printf("Unknown agent data buffer overflow policy %q, defaulting to %s\n", overflowPolicy, OverflowBlock)
+	}
+
+	// Get the API to subscribe to the log and platform events with, convert to lowercase
+	normalizedSubscriptionAPI := logsapi.TelemetryAPI
+	switch subscriptionAPI := logsapi.SubscriptionAPI(strings.ToLower(os.Getenv("ELASTIC_APM_LAMBDA_SUBSCRIPTION_API"))); subscriptionAPI {
+	case logsapi.LogsAPI:
+		normalizedSubscriptionAPI = subscriptionAPI
+	case "", logsapi.TelemetryAPI:
+	default:
+		log.Printf("Unknown subscription API %q, defaulting to %s\n", subscriptionAPI, logsapi.TelemetryAPI)
+	}
+
+	// Get the protocol the events are delivered with, convert to uppercase
+	normalizedLogsListenerProtocol := logsapi.HttpProto
+	switch protocol := logsapi.HttpProtocol(strings.ToUpper(os.Getenv("ELASTIC_APM_LAMBDA_LOGS_LISTENER_PROTOCOL"))); protocol {
+	case logsapi.TcpProto:
+		normalizedLogsListenerProtocol = protocol
+	case "", logsapi.HttpProto:
+	default:
+		log.Printf("Unknown logs listener protocol %q, defaulting to %s\n", protocol, logsapi.HttpProto)
 	}
 
 	// Get the send strategy, convert to lowercase
@@ -79,22 +234,156 @@ func ProcessEnv() *extensionConfig {
 
 	config := &extensionConfig{
 		apmServerUrl:               normalizedApmLambdaServer,
+		apmServerUrls:              apmServerUrls,
+		failoverCooldown:           time.Duration(getIntFromEnvOrDefault("ELASTIC_APM_LAMBDA_FAILOVER_COOLDOWN_SECONDS", 60)) * time.Second,
+		FlushDeadlineMargin:        time.Duration(getIntFromEnvOrDefault("ELASTIC_APM_LAMBDA_FLUSH_DEADLINE_MARGIN_MS", 100)) * time.Millisecond,
+		rateLimitStep:              time.Duration(getIntFromEnvOrDefault("ELASTIC_APM_LAMBDA_RATE_LIMIT_STEP_MS", 100)) * time.Millisecond,
+		rateLimitMaxInterval:       time.Duration(getIntFromEnvOrDefault("ELASTIC_APM_LAMBDA_RATE_LIMIT_MAX_INTERVAL_MS", 5000)) * time.Millisecond,
 		apmServerSecretToken:       os.Getenv("ELASTIC_APM_SECRET_TOKEN"),
 		apmServerApiKey:            os.Getenv("ELASTIC_APM_API_KEY"),
+		secretTokenSecretArn:       os.Getenv("ELASTIC_APM_LAMBDA_SECRET_TOKEN_SECRET_ARN"),
+		secretTokenParameter:       os.Getenv("ELASTIC_APM_LAMBDA_SECRET_TOKEN_PARAMETER"),
+		apiKeySecretArn:            os.Getenv("ELASTIC_APM_LAMBDA_API_KEY_SECRET_ARN"),
+		apiKeyParameter:            os.Getenv("ELASTIC_APM_LAMBDA_API_KEY_PARAMETER"),
+		secretsManagerEndpoint:     os.Getenv("ELASTIC_APM_LAMBDA_SECRETS_MANAGER_ENDPOINT"),
+		ssmEndpoint:                os.Getenv("ELASTIC_APM_LAMBDA_SSM_ENDPOINT"),
+		awsRegion:                  os.Getenv("AWS_REGION"),
+		credentialRefreshInterval:  time.Duration(getIntFromEnvOrDefault("ELASTIC_APM_LAMBDA_CREDENTIALS_REFRESH_INTERVAL_SECONDS", 60)) * time.Second,
 		dataReceiverServerPort:     os.Getenv("ELASTIC_APM_DATA_RECEIVER_SERVER_PORT"),
 		SendStrategy:               normalizedSendStrategy,
+		StreamAgentData:            getBoolFromEnv("ELASTIC_APM_LAMBDA_STREAM_AGENT_DATA"),
+		passthroughAgentData:       getBoolFromEnv("ELASTIC_APM_LAMBDA_PASSTHROUGH_AGENT_DATA"),
+		SendFunctionLogs:           getBoolFromEnv("ELASTIC_APM_LAMBDA_SEND_FUNCTION_LOGS"),
+		SendPlatformMetrics:        getBoolFromEnv("ELASTIC_APM_LAMBDA_SEND_PLATFORM_METRICS"),
+		SubscriptionAPI:            normalizedSubscriptionAPI,
+		LogsListenerProtocol:       normalizedLogsListenerProtocol,
+		passthroughRetainBytes:     getIntFromEnvOrDefault("ELASTIC_APM_LAMBDA_PASSTHROUGH_RETAIN_BYTES", 256*1024),
+		maxIntakeBodyBytes:         getIntFromEnvOrDefault("ELASTIC_APM_LAMBDA_MAX_INTAKE_BODY_BYTES", 5*1024*1024),
+		intakeRetryAfter:           time.Duration(getIntFromEnvOrDefault("ELASTIC_APM_LAMBDA_INTAKE_RETRY_AFTER_SECONDS", 1)) * time.Second,
 		dataReceiverTimeoutSeconds: dataReceiverTimeoutSeconds,
+		apmServerMaxRetries:        getIntFromEnvOrDefault("ELASTIC_APM_LAMBDA_MAX_RETRIES", 3),
+		apmServerRetryBackoff:      time.Duration(getIntFromEnvOrDefault("ELASTIC_APM_LAMBDA_RETRY_BACKOFF_MS", 100)) * time.Millisecond,
+		apmServerRetryMaxBackoff:   time.Duration(getIntFromEnvOrDefault("ELASTIC_APM_LAMBDA_RETRY_MAX_BACKOFF_MS", 2000)) * time.Millisecond,
+		circuitBreakerThreshold:    getIntFromEnvOrDefault("ELASTIC_APM_LAMBDA_CIRCUIT_BREAKER_THRESHOLD", 5),
+		circuitBreakerCooldown:     time.Duration(getIntFromEnvOrDefault("ELASTIC_APM_LAMBDA_CIRCUIT_BREAKER_COOLDOWN_SECONDS", 30)) * time.Second,
+		spoolDir:                   os.Getenv("ELASTIC_APM_LAMBDA_SPOOL_DIR"),
+		spoolMaxBytes:              int64(getIntFromEnvOrDefault("ELASTIC_APM_LAMBDA_SPOOL_SIZE_BYTES", 0)),
+		batchMaxBytes:              getIntFromEnvOrDefault("ELASTIC_APM_LAMBDA_BATCH_MAX_BYTES", 0),
+		batchMaxPayloads:           getIntFromEnvOrDefault("ELASTIC_APM_LAMBDA_BATCH_MAX_PAYLOADS", 0),
+		AgentDataBufferSize:        getIntFromEnvOrDefault("ELASTIC_APM_LAMBDA_AGENT_DATA_BUFFER_SIZE", 100),
+		AgentDataBufferBytes:       getIntFromEnvOrDefault("ELASTIC_APM_LAMBDA_AGENT_DATA_BUFFER_BYTES", 10*1024*1024),
+		AgentDataBufferOverflow:    normalizedOverflowPolicy,
+		agentDataBlockTimeout:      time.Duration(getIntFromEnvOrDefault("ELASTIC_APM_LAMBDA_AGENT_DATA_BUFFER_BLOCK_TIMEOUT_MS", 1000)) * time.Millisecond,
+		agentMaxMissedFlushes:      getIntFromEnvOrDefault("ELASTIC_APM_LAMBDA_AGENT_MAX_MISSED_FLUSHES", 3),
+		AgentFlushGracePeriod:      time.Duration(getIntFromEnvOrDefault("ELASTIC_APM_LAMBDA_AGENT_FLUSH_GRACE_PERIOD_MS", 200)) * time.Millisecond,
+		secondarySendTimeout:       time.Duration(getIntFromEnvOrDefault("ELASTIC_APM_LAMBDA_SECONDARY_SEND_TIMEOUT_MS", 5000)) * time.Millisecond,
+		secondaryGracePeriod:       time.Duration(getIntFromEnvOrDefault("ELASTIC_APM_LAMBDA_SECONDARY_GRACE_PERIOD_MS", 50)) * time.Millisecond,
+		tlsCACert:                  os.Getenv("ELASTIC_APM_LAMBDA_TLS_CA_CERT"),
+		tlsClientCert:              os.Getenv("ELASTIC_APM_LAMBDA_TLS_CLIENT_CERT"),
+		tlsClientKey:               os.Getenv("ELASTIC_APM_LAMBDA_TLS_CLIENT_KEY"),
+		tlsMinVersion:              os.Getenv("ELASTIC_APM_LAMBDA_TLS_MIN_VERSION"),
+		proxyURL:                   os.Getenv("ELASTIC_APM_LAMBDA_PROXY_URL"),
+		proxyUsername:              os.Getenv("ELASTIC_APM_LAMBDA_PROXY_USERNAME"),
+		proxyPassword:              os.Getenv("ELASTIC_APM_LAMBDA_PROXY_PASSWORD"),
+		noProxy:                    parseNoProxy(os.Getenv("ELASTIC_APM_LAMBDA_NO_PROXY")),
+		useFunctionProxy:           getBoolFromEnv("ELASTIC_APM_LAMBDA_USE_FUNCTION_PROXY"),
 	}
 
 	if config.dataReceiverServerPort == "" {
 		config.dataReceiverServerPort = ":8200"
 	}
+	config.tlsVerifyServerCert = true
+	if verifyServerCert := os.Getenv("ELASTIC_APM_LAMBDA_VERIFY_SERVER_CERT"); verifyServerCert != "" {
+		value, err := strconv.ParseBool(verifyServerCert)
+		if err != nil {
+			log.Printf("Could not read ELASTIC_APM_LAMBDA_VERIFY_SERVER_CERT, defaulting to true: %v\n", err)
+		} else {
+			config.tlsVerifyServerCert = value
+		}
+	}
+
+	config.SubscriptionTypes = []logsapi.EventType{logsapi.Platform}
+	if subscriptionTypes := os.Getenv("ELASTIC_APM_LAMBDA_SUBSCRIPTION_TYPES"); subscriptionTypes != "" {
+		config.SubscriptionTypes, err = logsapi.ParseEventTypes(subscriptionTypes)
+		if err != nil {
+			log.Fatalf("Invalid ELASTIC_APM_LAMBDA_SUBSCRIPTION_TYPES, exiting: %v", err)
+		}
+	}
+	if config.SendFunctionLogs && !hasEventType(config.SubscriptionTypes, logsapi.Function) {
+		config.SubscriptionTypes = append(config.SubscriptionTypes, logsapi.Function)
+	}
+	for _, setting := range []struct {
+		name         string
+		value        *uint32
+		defaultValue uint32
+	}{
+		{"ELASTIC_APM_LAMBDA_SUBSCRIPTION_MAX_ITEMS", &config.SubscriptionBuffering.MaxItems, logsapi.DefaultBufferingCfg.MaxItems},
+		{"ELASTIC_APM_LAMBDA_SUBSCRIPTION_MAX_BYTES", &config.SubscriptionBuffering.MaxBytes, logsapi.DefaultBufferingCfg.MaxBytes},
+		{"ELASTIC_APM_LAMBDA_SUBSCRIPTION_TIMEOUT_MS", &config.SubscriptionBuffering.TimeoutMS, logsapi.DefaultBufferingCfg.TimeoutMS},
+	} {
+		if *setting.value, err = getUint32FromEnvOrDefault(setting.name, setting.defaultValue); err != nil {
+			log.Fatalf("Invalid %s, exiting: %v", setting.name, err)
+		}
+	}
+	if err := config.SubscriptionBuffering.Validate(); err != nil {
+		log.Fatalf("Invalid ELASTIC_APM_LAMBDA_SUBSCRIPTION_MAX_ITEMS, _MAX_BYTES or _TIMEOUT_MS, exiting: %v", err)
+	}
+
+	secondaryDestinations, err := parseSecondaryDestinations(os.Getenv("ELASTIC_APM_LAMBDA_SECONDARY_DESTINATIONS"))
+	if err != nil {
+		log.Printf("Could not read ELASTIC_APM_LAMBDA_SECONDARY_DESTINATIONS, only sending to the primary APM server: %v\n", err)
+	}
+	config.secondaryDestinations = secondaryDestinations
+	if config.passthroughAgentData && len(config.secondaryDestinations) > 0 {
+		log.Println("Passing agent data through is not supported with secondary destinations, buffering it instead")
+		config.passthroughAgentData = false
+	}
+
+	if config.spoolDir == "" {
+		config.spoolDir = "/tmp/elastic-apm-lambda-spool"
+	}
 	if config.apmServerUrl == "" {
 		log.Fatalln("please set ELASTIC_APM_LAMBDA_APM_SERVER, exiting")
 	}
-	if config.apmServerSecretToken == "" && config.apmServerApiKey == "" {
-		log.Fatalln("please set ELASTIC_APM_SECRET_TOKEN or ELASTIC_APM_API_KEY, exiting")
+	// With IAM authorization, requests are signed with the execution role
+	// credentials rather than carrying a secret token or API key
+	switch auth := strings.ToLower(os.Getenv("ELASTIC_APM_LAMBDA_APM_SERVER_AUTH")); auth {
+	case "sigv4":
+		config.sigV4Signer = newSigV4Signer(getStringFromEnvOrDefault("ELASTIC_APM_LAMBDA_SIGV4_SERVICE", "execute-api"),
+			getStringFromEnvOrDefault("ELASTIC_APM_LAMBDA_SIGV4_REGION", config.awsRegion))
+		if config.StreamAgentData {
+			log.Println("Streaming agent data is not supported with SigV4 authentication, sending one request per payload")
+			config.StreamAgentData = false
+		}
+		if config.passthroughAgentData {
+			log.Println("Passing agent data through is not supported with SigV4 authentication, buffering it instead")
+			config.passthroughAgentData = false
+		}
+		return config
+	case "":
+	default:
+		log.Fatalf("Unknown ELASTIC_APM_LAMBDA_APM_SERVER_AUTH %q, exiting", auth)
 	}
 
+	// Credentials kept in Secrets Manager or Parameter Store take precedence
+	// over the plaintext environment variables
+	credentials, err := newCredentialManager(newCredentialProvider(config), config.credentialRefreshInterval)
+	if err != nil {
+		log.Fatalf("Could not retrieve the APM server credentials, exiting: %v", err)
+	}
+	if current := credentials.get(); current.SecretToken == "" && current.ApiKey == "" {
+		log.Fatalln("please set ELASTIC_APM_SECRET_TOKEN or ELASTIC_APM_API_KEY, or the secret or parameter holding one of them, exiting")
+	}
+	config.credentials = credentials
+
 	return config
 }
+
+func hasEventType(eventTypes []logsapi.EventType, eventType logsapi.EventType) bool {
+	for _, t := range eventTypes {
+		if t == eventType {
+			return true
+		}
+	}
+	return false
+}
@@ -19,7 +19,11 @@ package extension
 
 import (
 	"os"
+	"reflect"
+	"strings"
 	"testing"
+
+	"elastic/apm-lambda-extension/logsapi"
 )
 
 func TestProcessEnv(t *testing.T) {
@@ -107,3 +111,101 @@ func TestProcessEnv(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestProcessEnvSubscription(t *testing.T) {
+	os.Setenv("ELASTIC_APM_LAMBDA_APM_SERVER", "foo.example.com")
+	os.Setenv("ELASTIC_APM_SECRET_TOKEN", "bar")
+	defer os.Unsetenv("ELASTIC_APM_LAMBDA_APM_SERVER")
+	defer os.Unsetenv("ELASTIC_APM_SECRET_TOKEN")
+
+	config := ProcessEnv()
+	if !reflect.DeepEqual(config.SubscriptionTypes, []logsapi.EventType{logsapi.Platform}) {
+		t.Logf("Default subscription types not set correctly: %v", config.SubscriptionTypes)
+		t.Fail()
+	}
+	if config.SubscriptionBuffering != logsapi.DefaultBufferingCfg {
+		t.Logf("Default subscription buffering not set correctly: %v", config.SubscriptionBuffering)
+		t.Fail()
+	}
+	if config.LogsListenerProtocol != logsapi.HttpProto {
+		t.Logf("Default logs listener protocol not set correctly: %v", config.LogsListenerProtocol)
+		t.Fail()
+	}
+
+	os.Setenv("ELASTIC_APM_LAMBDA_SUBSCRIPTION_TYPES", "Platform")
+	os.Setenv("ELASTIC_APM_LAMBDA_SEND_FUNCTION_LOGS", "true")
+	os.Setenv("ELASTIC_APM_LAMBDA_SUBSCRIPTION_MAX_ITEMS", "1000")
+	os.Setenv("ELASTIC_APM_LAMBDA_SUBSCRIPTION_MAX_BYTES", "1048576")
+	os.Setenv("ELASTIC_APM_LAMBDA_SUBSCRIPTION_TIMEOUT_MS", "1000")
+	os.Setenv("ELASTIC_APM_LAMBDA_LOGS_LISTENER_PROTOCOL", "tcp")
+	defer os.Unsetenv("ELASTIC_APM_LAMBDA_LOGS_LISTENER_PROTOCOL")
+	defer os.Unsetenv("ELASTIC_APM_LAMBDA_SUBSCRIPTION_TYPES")
+	defer os.Unsetenv("ELASTIC_APM_LAMBDA_SEND_FUNCTION_LOGS")
+	defer os.Unsetenv("ELASTIC_APM_LAMBDA_SUBSCRIPTION_MAX_ITEMS")
+	defer os.Unsetenv("ELASTIC_APM_LAMBDA_SUBSCRIPTION_MAX_BYTES")
+	defer os.Unsetenv("ELASTIC_APM_LAMBDA_SUBSCRIPTION_TIMEOUT_MS")
+
+	config = ProcessEnv()
+	// Function logs are subscribed to when they are sent to the APM server
+	if !reflect.DeepEqual(config.SubscriptionTypes, []logsapi.EventType{logsapi.Platform, logsapi.Function}) {
+		t.Logf("Subscription types not set correctly: %v", config.SubscriptionTypes)
+		t.Fail()
+	}
+	if config.SubscriptionBuffering != (logsapi.BufferingCfg{MaxItems: 1000, MaxBytes: 1048576, TimeoutMS: 1000}) {
+		t.Logf("Subscription buffering not set correctly: %v", config.SubscriptionBuffering)
+		t.Fail()
+	}
+	if config.LogsListenerProtocol != logsapi.TcpProto {
+		t.Logf("Logs listener protocol not set correctly: %v", config.LogsListenerProtocol)
+		t.Fail()
+	}
+}
+
+func TestReadIntFromEnvOrDefault(t *testing.T) {
+	defer os.Unsetenv("ELASTIC_APM_LAMBDA_BATCH_MAX_BYTES")
+
+	if value, err := readIntFromEnvOrDefault("ELASTIC_APM_LAMBDA_BATCH_MAX_BYTES", 42); err != nil || value != 42 {
+		t.Logf("Default value not returned: %v, %v", value, err)
+		t.Fail()
+	}
+
+	os.Setenv("ELASTIC_APM_LAMBDA_BATCH_MAX_BYTES", "0")
+	if value, err := readIntFromEnvOrDefault("ELASTIC_APM_LAMBDA_BATCH_MAX_BYTES", 42); err != nil || value != 0 {
+		t.Logf("Value not read correctly: %v, %v", value, err)
+		t.Fail()
+	}
+
+	// Invalid values are reported with the name of the variable and the value
+	for _, invalid := range []string{"-1", "1k"} {
+		os.Setenv("ELASTIC_APM_LAMBDA_BATCH_MAX_BYTES", invalid)
+		_, err := readIntFromEnvOrDefault("ELASTIC_APM_LAMBDA_BATCH_MAX_BYTES", 42)
+		if err == nil || !strings.Contains(err.Error(), "ELASTIC_APM_LAMBDA_BATCH_MAX_BYTES") || !strings.Contains(err.Error(), invalid) {
+			t.Logf("Invalid value %s not reported: %v", invalid, err)
+			t.Fail()
+		}
+	}
+}
+
+func TestGetUint32FromEnvOrDefault(t *testing.T) {
+	defer os.Unsetenv("ELASTIC_APM_LAMBDA_SUBSCRIPTION_MAX_ITEMS")
+
+	if value, err := getUint32FromEnvOrDefault("ELASTIC_APM_LAMBDA_SUBSCRIPTION_MAX_ITEMS", 42); err != nil || value != 42 {
+		t.Logf("Default value not returned: %v, %v", value, err)
+		t.Fail()
+	}
+
+	os.Setenv("ELASTIC_APM_LAMBDA_SUBSCRIPTION_MAX_ITEMS", "4294967295")
+	if value, err := getUint32FromEnvOrDefault("ELASTIC_APM_LAMBDA_SUBSCRIPTION_MAX_ITEMS", 42); err != nil || value != 4294967295 {
+		t.Logf("Value not read correctly: %v, %v", value, err)
+		t.Fail()
+	}
+
+	// Values that do not fit are reported rather than wrapped or replaced by the default
+	for _, invalid := range []string{"4294967296", "-1", "1k"} {
+		os.Setenv("ELASTIC_APM_LAMBDA_SUBSCRIPTION_MAX_ITEMS", invalid)
+		if _, err := getUint32FromEnvOrDefault("ELASTIC_APM_LAMBDA_SUBSCRIPTION_MAX_ITEMS", 42); err == nil {
+			t.Logf("Invalid value %s not reported", invalid)
+			t.Fail()
+		}
+	}
+}
@@ -18,7 +18,9 @@
 package extension
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"log"
 	"net/http"
 )
@@ -29,20 +31,157 @@ func ProcessShutdown() {
 	agentDataServer.Close()
 }
 
-func FlushAPMData(client *http.Client, dataChannel chan AgentData, config *extensionConfig) {
+func FlushAPMData(ctx context.Context, client *http.Client, dataBuffer *AgentDataBuffer, config *extensionConfig) {
 	log.Println("Checking for agent data")
 	for {
-		select {
-		case agentData := <-dataChannel:
-			log.Println("Processing agent data")
-			err := PostToApmServer(client, agentData, config)
-			if err != nil {
-				log.Printf("Error sending to APM server, skipping: %v", err)
-			}
-		default:
+		agentData, ok := dataBuffer.TryGet()
+		if !ok {
 			log.Println("No agent data on buffer")
 			return
 		}
+		log.Println("Processing agent data")
+		if err := SendAgentData(ctx, client, agentData, dataBuffer, config); err != nil {
+			log.Printf("Deferring the remaining agent data to the next invocation: %v", err)
+			return
+		}
+	}
+}
+
+// SendAgentData posts the agent data to the APM server. When batching is
+// enabled, by limiting either the size or the number of payloads of a batch,
+// it is coalesced with the agent data already waiting in the buffer.
+// If the APM server is throttling requests, or the context is done, the agent
+// data that is left is deferred and an error is returned, so that the caller
+// stops sending.
+func SendAgentData(ctx context.Context, client *http.Client, agentData AgentData, dataBuffer *AgentDataBuffer, config *extensionConfig) error {
+	payloads := []AgentData{agentData}
+	if config.batchMaxBytes > 0 || config.batchMaxPayloads > 0 {
+		payloads = append(payloads, drainAgentData(dataBuffer)...)
+		payloads = batchAgentData(payloads, config.batchMaxBytes, config.batchMaxPayloads)
+		log.Printf("Sending agent data in %d requests", len(payloads))
+	}
+	return sendPayloads(ctx, client, payloads, dataBuffer, config)
+}
+
+// sendPayloads posts each payload to the APM server in turn, and defers the
+// payloads that are left once the APM server throttles requests or the
+// context is done
+func sendPayloads(ctx context.Context, client *http.Client, payloads []AgentData, dataBuffer *AgentDataBuffer, config *extensionConfig) error {
+	for i, payload := range payloads {
+		err := PostToApmServer(ctx, client, payload, config)
+		if err != nil && ctx.Err() != nil {
+			deferAgentData(payloads[i:], dataBuffer, err)
+			return ctx.Err()
+		}
+		if err != nil && isThrottled(err) {
+			recordThrottled(0, len(payloads[i:]))
+			deferAgentData(payloads[i:], dataBuffer, err)
+			return ErrThrottled
+		}
+		if err != nil {
+			HandleSendFailure(payload, err)
+		}
+	}
+	return nil
+}
+
+// drainAgentData returns all the agent data currently waiting in the buffer
+func drainAgentData(dataBuffer *AgentDataBuffer) []AgentData {
+	var payloads []AgentData
+	for {
+		agentData, ok := dataBuffer.TryGet()
+		if !ok {
+			return payloads
+		}
+		payloads = append(payloads, agentData)
+	}
+}
+
+var (
+	// ErrShuttingDown is the reason agent data is spooled when the extension
+	// shuts down, as the buffer does not outlive the extension
+	ErrShuttingDown = errors.New("extension is shutting down")
+
+	// ErrSpoolNotReplayed is the reason agent data is spooled when the agent
+	// data spooled earlier could not be replayed, as new agent data must not
+	// be sent ahead of it
+	ErrSpoolNotReplayed = errors.New("spooled agent data could not be replayed yet")
+)
+
+// SpoolAgentData moves the given agent data, followed by the agent data left
+// in the buffer, to the spool
+func SpoolAgentData(dataBuffer *AgentDataBuffer, reason error, agentData ...AgentData) {
+	if payloads := append(agentData, drainAgentData(dataBuffer)...); len(payloads) > 0 {
+		deferAgentData(payloads, nil, reason)
+	}
+}
+
+// spoolPending reports whether spooled agent data waits to be replayed
+func spoolPending() bool {
+	return agentDataSpool != nil && agentDataSpool.Len() > 0
+}
+
+// ReplaySpool sends the agent data that was spooled on earlier invocations
+// to the APM server, oldest first. It stops at the first failure, so that the
+// remaining entries are kept in order for the next attempt, and reports
+// whether the spool was replayed entirely.
+func ReplaySpool(ctx context.Context, client *http.Client, config *extensionConfig) bool {
+	if agentDataSpool == nil {
+		return true
+	}
+	for {
+		agentData, ok := agentDataSpool.Peek()
+		if !ok {
+			return true
+		}
+		log.Println("Replaying spooled agent data")
+		err := PostToApmServer(ctx, client, agentData, config)
+		if err != nil && IsRetryable(err) {
+			log.Printf("Error replaying spooled agent data, %d entries left: %v", agentDataSpool.Len(), err)
+			return false
+		}
+		if err != nil {
+			log.Printf("APM server rejected spooled agent data, dropping it: %v", err)
+		}
+		agentDataSpool.Pop()
+	}
+}
+
+// deferAgentData keeps agent data that could not be sent in time for a later
+// attempt, in the spool if it is enabled and in the buffer otherwise
+func deferAgentData(agentData []AgentData, dataBuffer *AgentDataBuffer, err error) {
+	if agentDataSpool != nil {
+		log.Printf("Spooling %d payloads for a later attempt: %v", len(agentData), err)
+		for _, data := range agentData {
+			if err := agentDataSpool.Push(data); err != nil {
+				log.Printf("Could not spool agent data, skipping: %v", err)
+			}
+		}
+		return
+	}
+	if dataBuffer == nil {
+		log.Printf("Could not send %d payloads in time, skipping: %v", len(agentData), err)
+		return
+	}
+	log.Printf("Keeping %d payloads in the buffer for a later attempt: %v", len(agentData), err)
+	dataBuffer.Requeue(agentData...)
+}
+
+// HandleSendFailure stores agent data that could not be sent to the APM
+// server in the spool, or drops it when spooling is disabled. Agent data
+// rejected by the APM server is always dropped, as it would be rejected again.
+func HandleSendFailure(agentData AgentData, err error) {
+	if !IsRetryable(err) {
+		log.Printf("APM server rejected agent data, dropping it: %v", err)
+		return
+	}
+	if agentDataSpool == nil {
+		log.Printf("Error sending to APM server, skipping: %v", err)
+		return
+	}
+	log.Printf("Error sending to APM server, spooling agent data: %v", err)
+	if err := agentDataSpool.Push(agentData); err != nil {
+		log.Printf("Could not spool agent data, skipping: %v", err)
 	}
 }
 
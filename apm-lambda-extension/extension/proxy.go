@@ -0,0 +1,104 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package extension
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// environmentProxy selects the proxy from the HTTP_PROXY variables of the function
+var environmentProxy = http.ProxyFromEnvironment
+
+// newProxyFunc returns the proxy selection used by the APM server client.
+// It only depends on the ELASTIC_APM_LAMBDA_PROXY_* settings, and not on the
+// HTTP_PROXY variables of the function, so that the function traffic and the
+// traffic to the APM server can be routed differently. The variables of the
+// function are only used when opted into, and no proxy of the extension is
+// set. A nil function means that the APM server is reached directly.
+func newProxyFunc(config *extensionConfig) (func(*http.Request) (*url.URL, error), error) {
+	if config.proxyURL == "" {
+		if config.useFunctionProxy {
+			return environmentProxy, nil
+		}
+		return nil, nil
+	}
+	proxyURL, err := url.Parse(config.proxyURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy URL: %v", err)
+	}
+	if proxyURL.Scheme != "http" && proxyURL.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported proxy URL scheme %q", proxyURL.Scheme)
+	}
+	if config.proxyUsername != "" {
+		proxyURL.User = url.UserPassword(config.proxyUsername, config.proxyPassword)
+	}
+
+	return func(req *http.Request) (*url.URL, error) {
+		if bypassProxy(req.URL.Hostname(), config.noProxy) {
+			return nil, nil
+		}
+		return proxyURL, nil
+	}, nil
+}
+
+// parseNoProxy splits the comma separated list of hosts that are reached
+// without going through the proxy
+func parseNoProxy(value string) []string {
+	var hosts []string
+	for _, host := range strings.Split(value, ",") {
+		host = strings.ToLower(strings.TrimSpace(host))
+		if host != "" {
+			hosts = append(hosts, host)
+		}
+	}
+	return hosts
+}
+
+// bypassProxy reports whether the host matches an entry of the no-proxy list,
+// which holds host names, matching their subdomains too, IP addresses, CIDR
+// ranges, or "*" to bypass the proxy for all hosts
+func bypassProxy(host string, noProxy []string) bool {
+	host = strings.ToLower(host)
+	ip := net.ParseIP(host)
+	for _, entry := range noProxy {
+		if entry == "*" {
+			return true
+		}
+		if ip != nil {
+			if _, network, err := net.ParseCIDR(entry); err == nil {
+				if network.Contains(ip) {
+					return true
+				}
+				continue
+			}
+			if entryIP := net.ParseIP(entry); entryIP != nil && entryIP.Equal(ip) {
+				return true
+			}
+			continue
+		}
+		domain := strings.TrimPrefix(entry, ".")
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,175 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package extension
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sync"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+func newTestProxy(t *testing.T) (*httptest.Server, func() []*http.Request) {
+	var mu sync.Mutex
+	var requests []*http.Request
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests = append(requests, r)
+		mu.Unlock()
+		if r.Method == http.MethodConnect {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	return proxy, func() []*http.Request {
+		mu.Lock()
+		defer mu.Unlock()
+		return requests
+	}
+}
+
+func TestApmServerClientProxy(t *testing.T) {
+	proxy, requests := newTestProxy(t)
+	defer proxy.Close()
+
+	client, err := NewApmServerClient(&extensionConfig{
+		proxyURL:            proxy.URL,
+		proxyUsername:       "user",
+		proxyPassword:       "secret",
+		tlsVerifyServerCert: true,
+	})
+	assert.NilError(t, err)
+
+	resp, err := client.Get("http://apm.example.com/intake/v2/events")
+	assert.NilError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+
+	// HTTPS requests go through a CONNECT tunnel, which the test proxy refuses
+	_, err = client.Get("https://apm.example.com/intake/v2/events")
+	assert.Assert(t, err != nil)
+
+	credentials := "Basic " + base64.StdEncoding.EncodeToString([]byte("user:secret"))
+	received := requests()
+	assert.Equal(t, 2, len(received))
+	assert.Equal(t, "apm.example.com", received[0].Host)
+	assert.Equal(t, credentials, received[0].Header.Get("Proxy-Authorization"))
+	assert.Equal(t, http.MethodConnect, received[1].Method)
+	assert.Equal(t, credentials, received[1].Header.Get("Proxy-Authorization"))
+}
+
+func TestApmServerClientNoProxy(t *testing.T) {
+	proxy, requests := newTestProxy(t)
+	defer proxy.Close()
+	apmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer apmServer.Close()
+
+	client, err := NewApmServerClient(&extensionConfig{
+		proxyURL:            proxy.URL,
+		noProxy:             parseNoProxy("127.0.0.0/8"),
+		tlsVerifyServerCert: true,
+	})
+	assert.NilError(t, err)
+
+	resp, err := client.Get(apmServer.URL)
+	assert.NilError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, 0, len(requests()))
+}
+
+func TestApmServerClientIgnoresFunctionProxy(t *testing.T) {
+	proxy, requests := newTestProxy(t)
+	defer proxy.Close()
+	apmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer apmServer.Close()
+
+	os.Setenv("HTTP_PROXY", proxy.URL)
+	defer os.Unsetenv("HTTP_PROXY")
+	client, err := NewApmServerClient(&extensionConfig{tlsVerifyServerCert: true})
+	assert.NilError(t, err)
+	assert.Assert(t, client.Transport.(*http.Transport).Proxy == nil)
+
+	resp, err := client.Get(apmServer.URL)
+	assert.NilError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, 0, len(requests()))
+}
+
+func TestProxyFuncFunctionProxy(t *testing.T) {
+	functionProxy, _ := url.Parse("http://function-proxy.internal:3128")
+	defer func() { environmentProxy = http.ProxyFromEnvironment }()
+	environmentProxy = func(*http.Request) (*url.URL, error) { return functionProxy, nil }
+	req := httptest.NewRequest("POST", "https://apm.example.com/intake/v2/events", nil)
+
+	for _, test := range []struct {
+		name   string
+		config extensionConfig
+		want   string
+	}{
+		{"direct by default", extensionConfig{}, ""},
+		{"function proxy when opted into", extensionConfig{useFunctionProxy: true}, "http://function-proxy.internal:3128"},
+		{"extension proxy first", extensionConfig{useFunctionProxy: true, proxyURL: "http://extension-proxy.internal:3128"}, "http://extension-proxy.internal:3128"},
+	} {
+		proxy, err := newProxyFunc(&test.config)
+		assert.NilError(t, err)
+		got := ""
+		if proxy != nil {
+			proxyURL, err := proxy(req)
+			assert.NilError(t, err)
+			if proxyURL != nil {
+				got = proxyURL.String()
+			}
+		}
+		assert.Equal(t, test.want, got, test.name)
+	}
+}
+
+func TestApmServerClientInvalidProxy(t *testing.T) {
+	_, err := NewApmServerClient(&extensionConfig{proxyURL: "socks5://proxy:1080", tlsVerifyServerCert: true})
+	assert.ErrorContains(t, err, "unsupported proxy URL scheme")
+}
+
+func TestBypassProxy(t *testing.T) {
+	noProxy := parseNoProxy("internal.example.com, .corp.local,10.0.0.0/8, 192.168.1.1")
+	for host, bypass := range map[string]bool{
+		"internal.example.com":     true,
+		"apm.internal.example.com": true,
+		"example.com":              false,
+		"notinternal.example.com":  false,
+		"apm.corp.local":           true,
+		"corp.local":               true,
+		"10.1.2.3":                 true,
+		"11.1.2.3":                 false,
+		"192.168.1.1":              true,
+		"192.168.1.2":              false,
+	} {
+		assert.Equal(t, bypass, bypassProxy(host, noProxy), host)
+	}
+	assert.Assert(t, bypassProxy("anything.example.com", parseNoProxy("*")))
+}
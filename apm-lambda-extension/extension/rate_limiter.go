@@ -0,0 +1,201 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package extension
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ErrThrottled is returned when agent data is held back because the APM
+// server asked for requests to slow down, and waiting for the next allowed
+// request would run past the deadline
+var ErrThrottled = errors.New("APM server is throttling requests")
+
+// ThrottleStats summarizes how the APM server throttled the extension since
+// it started
+type ThrottleStats struct {
+	Throttled time.Duration
+	Deferred  int
+}
+
+var (
+	throttleStatsMutex sync.Mutex
+	throttleStats      ThrottleStats
+)
+
+// GetThrottleStats returns the time spent waiting on the APM server rate
+// limits, and the number of payloads deferred because of them
+func GetThrottleStats() ThrottleStats {
+	throttleStatsMutex.Lock()
+	defer throttleStatsMutex.Unlock()
+	return throttleStats
+}
+
+func (s ThrottleStats) String() string {
+	return fmt.Sprintf("time throttled: %v, payloads deferred: %d", s.Throttled, s.Deferred)
+}
+
+func recordThrottled(delay time.Duration, deferred int) {
+	throttleStatsMutex.Lock()
+	defer throttleStatsMutex.Unlock()
+	throttleStats.Throttled += delay
+	throttleStats.Deferred += deferred
+}
+
+// rateLimiter spaces out the requests sent to an APM server that responds
+// with 429 or 503. Each such response doubles the interval between requests,
+// up to a maximum, while each successful request shortens it by a fixed step,
+// until requests are sent without delay again. A Retry-After header holds back
+// all requests until the time given by the APM server. The state lives as long
+// as the extension process, so it carries over from one invocation to the next.
+type rateLimiter struct {
+	sync.Mutex
+	interval       time.Duration
+	nextRequest    time.Time
+	blockedUntil   time.Time
+	throttledSince time.Time
+	now            func() time.Time
+	sleep          func(context.Context, time.Duration) bool
+}
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{now: time.Now, sleep: sleepContext}
+}
+
+// wait blocks until the next request may be sent to the APM server. It
+// returns ErrThrottled right away if that would be after the context
+// deadline, and the context error if the context is done while waiting.
+func (l *rateLimiter) wait(ctx context.Context) error {
+	deadline, _ := ctx.Deadline()
+	delay, err := l.reserve(deadline)
+	if err != nil || delay == 0 {
+		return err
+	}
+	recordThrottled(delay, 0)
+	if !l.sleep(ctx, delay) {
+		return ctx.Err()
+	}
+	return nil
+}
+
+// tryAcquire claims the next request slot if a request may be sent right away
+func (l *rateLimiter) tryAcquire() bool {
+	_, err := l.reserve(l.now())
+	return err == nil
+}
+
+// reserve claims the next request slot and returns how long to wait for it.
+// It returns ErrThrottled if the slot is after the deadline, a zero deadline
+// means that any slot will do.
+func (l *rateLimiter) reserve(deadline time.Time) (time.Duration, error) {
+	l.Lock()
+	now := l.now()
+	next := l.nextRequest
+	if l.blockedUntil.After(next) {
+		next = l.blockedUntil
+	}
+	if !next.After(now) {
+		l.nextRequest = now.Add(l.interval)
+		l.Unlock()
+		return 0, nil
+	}
+	if !deadline.IsZero() && next.After(deadline) {
+		l.Unlock()
+		return 0, fmt.Errorf("%w, next request allowed in %v", ErrThrottled, next.Sub(now))
+	}
+	l.nextRequest = next.Add(l.interval)
+	l.Unlock()
+	return next.Sub(now), nil
+}
+
+// observe adapts the interval between requests to the outcome of a request
+func (l *rateLimiter) observe(err error, step time.Duration, maxInterval time.Duration) {
+	l.Lock()
+	defer l.Unlock()
+
+	now := l.now()
+	var apmServerErr *ApmServerError
+	if errors.As(err, &apmServerErr) && isThrottlingStatus(apmServerErr.StatusCode) {
+		if l.throttledSince.IsZero() {
+			log.Printf("APM server is throttling requests with status code %d", apmServerErr.StatusCode)
+			l.throttledSince = now
+		}
+		if l.interval < step {
+			l.interval = step
+		} else {
+			l.interval *= 2
+		}
+		if maxInterval > 0 && l.interval > maxInterval {
+			l.interval = maxInterval
+		}
+		if blockedUntil := now.Add(apmServerErr.RetryAfter); blockedUntil.After(l.blockedUntil) {
+			l.blockedUntil = blockedUntil
+		}
+		return
+	}
+	if err != nil {
+		return
+	}
+	if !l.throttledSince.IsZero() {
+		log.Printf("APM server accepted a request after throttling for %v", now.Sub(l.throttledSince))
+		l.throttledSince = time.Time{}
+	}
+	l.interval -= step
+	if l.interval < 0 {
+		l.interval = 0
+	}
+}
+
+func isThrottlingStatus(statusCode int) bool {
+	return statusCode == http.StatusTooManyRequests || statusCode == http.StatusServiceUnavailable
+}
+
+// isThrottled reports whether agent data failed to send because the APM
+// server asked for requests to slow down
+func isThrottled(err error) bool {
+	var apmServerErr *ApmServerError
+	if errors.As(err, &apmServerErr) {
+		return isThrottlingStatus(apmServerErr.StatusCode)
+	}
+	return errors.Is(err, ErrThrottled)
+}
+
+// parseRetryAfter returns the delay given by a Retry-After header, either in
+// seconds or as an HTTP date
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil && date.After(now) {
+		return date.Sub(now)
+	}
+	return 0
+}
@@ -0,0 +1,156 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package extension
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+)
+
+func newTestRateLimiter(now *time.Time, slept *time.Duration) *rateLimiter {
+	limiter := newRateLimiter()
+	limiter.now = func() time.Time { return *now }
+	limiter.sleep = func(ctx context.Context, d time.Duration) bool {
+		*slept += d
+		*now = now.Add(d)
+		return true
+	}
+	return limiter
+}
+
+func TestRateLimiterAdaptsInterval(t *testing.T) {
+	now := time.Now()
+	var slept time.Duration
+	limiter := newTestRateLimiter(&now, &slept)
+	throttled := &ApmServerError{StatusCode: http.StatusTooManyRequests}
+
+	limiter.observe(throttled, 100*time.Millisecond, 300*time.Millisecond)
+	assert.Equal(t, 100*time.Millisecond, limiter.interval)
+	limiter.observe(throttled, 100*time.Millisecond, 300*time.Millisecond)
+	assert.Equal(t, 200*time.Millisecond, limiter.interval)
+	limiter.observe(throttled, 100*time.Millisecond, 300*time.Millisecond)
+	assert.Equal(t, 300*time.Millisecond, limiter.interval)
+
+	// Other errors leave the interval alone
+	limiter.observe(&ApmServerError{StatusCode: http.StatusBadRequest}, 100*time.Millisecond, 300*time.Millisecond)
+	assert.Equal(t, 300*time.Millisecond, limiter.interval)
+
+	limiter.observe(nil, 100*time.Millisecond, 300*time.Millisecond)
+	assert.Equal(t, 200*time.Millisecond, limiter.interval)
+	limiter.observe(nil, 100*time.Millisecond, 300*time.Millisecond)
+	limiter.observe(nil, 100*time.Millisecond, 300*time.Millisecond)
+	limiter.observe(nil, 100*time.Millisecond, 300*time.Millisecond)
+	assert.Equal(t, time.Duration(0), limiter.interval)
+}
+
+func TestRateLimiterSpacesRequests(t *testing.T) {
+	now := time.Now()
+	var slept time.Duration
+	limiter := newTestRateLimiter(&now, &slept)
+	limiter.observe(&ApmServerError{StatusCode: http.StatusServiceUnavailable}, 100*time.Millisecond, time.Second)
+
+	assert.NilError(t, limiter.wait(context.Background()))
+	assert.Equal(t, time.Duration(0), slept)
+	assert.NilError(t, limiter.wait(context.Background()))
+	assert.Equal(t, 100*time.Millisecond, slept)
+}
+
+func TestRateLimiterHonoursRetryAfter(t *testing.T) {
+	now := time.Now()
+	var slept time.Duration
+	limiter := newTestRateLimiter(&now, &slept)
+	limiter.observe(&ApmServerError{StatusCode: http.StatusTooManyRequests, RetryAfter: 5 * time.Second}, 0, 0)
+
+	ctx, cancel := context.WithDeadline(context.Background(), now.Add(time.Second))
+	defer cancel()
+	err := limiter.wait(ctx)
+	assert.Assert(t, errors.Is(err, ErrThrottled))
+	assert.Equal(t, time.Duration(0), slept)
+	assert.Assert(t, !limiter.tryAcquire())
+
+	ctx, cancel = context.WithDeadline(context.Background(), now.Add(10*time.Second))
+	defer cancel()
+	assert.NilError(t, limiter.wait(ctx))
+	assert.Equal(t, 5*time.Second, slept)
+}
+
+func TestRateLimiterWaitIsCancelled(t *testing.T) {
+	limiter := newRateLimiter()
+	limiter.observe(&ApmServerError{StatusCode: http.StatusTooManyRequests, RetryAfter: time.Hour}, 0, 0)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+	start := time.Now()
+	err := limiter.wait(ctx)
+	assert.Assert(t, errors.Is(err, context.Canceled))
+	assert.Assert(t, time.Since(start) < time.Minute)
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2021, 9, 1, 12, 0, 0, 0, time.UTC)
+	assert.Equal(t, 30*time.Second, parseRetryAfter("30", now))
+	assert.Equal(t, 90*time.Second, parseRetryAfter("Wed, 01 Sep 2021 12:01:30 GMT", now))
+	assert.Equal(t, time.Duration(0), parseRetryAfter("Wed, 01 Sep 2021 11:00:00 GMT", now))
+	assert.Equal(t, time.Duration(0), parseRetryAfter("soon", now))
+	assert.Equal(t, time.Duration(0), parseRetryAfter("", now))
+}
+
+func TestFlushAPMDataDefersThrottledAgentData(t *testing.T) {
+	var requests int32
+	apmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.Header().Set("Retry-After", "60")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer apmServer.Close()
+
+	config := extensionConfig{
+		apmServerUrl:          apmServer.URL + "/",
+		apmServerMaxRetries:   3,
+		apmServerRetryBackoff: time.Millisecond,
+		rateLimitStep:         100 * time.Millisecond,
+	}
+	dataBuffer := NewAgentDataBuffer(100, 0, OverflowBlock)
+	dataBuffer.Add(AgentData{Data: []byte("first")}, nil)
+	dataBuffer.Add(AgentData{Data: []byte("second")}, nil)
+	statsBefore := GetThrottleStats()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	FlushAPMData(ctx, apmServer.Client(), dataBuffer, &config)
+
+	// The Retry-After delay is beyond the deadline, so there is a single
+	// request and the agent data is kept in the buffer, in order
+	assert.Equal(t, int32(1), atomic.LoadInt32(&requests))
+	assert.Equal(t, 2, dataBuffer.Len())
+	first, _ := dataBuffer.TryGet()
+	assert.Equal(t, "first", string(first.Data))
+	assert.Equal(t, 1, GetThrottleStats().Deferred-statsBefore.Deferred)
+
+	// The next attempt is held back without contacting the APM server
+	err := PostToApmServer(ctx, apmServer.Client(), first, &config)
+	assert.Assert(t, errors.Is(err, ErrThrottled))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&requests))
+}
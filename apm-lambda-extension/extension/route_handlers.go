@@ -18,6 +18,8 @@
 package extension
 
 import (
+	"context"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
@@ -29,32 +31,33 @@ type AgentData struct {
 	ContentEncoding string
 }
 
-var AgentDoneSignal chan struct{}
-
 // URL: http://server/
-func handleInfoRequest(apmServerUrl string) func(w http.ResponseWriter, r *http.Request) {
+func handleInfoRequest(client *http.Client, config *extensionConfig) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		client := &http.Client{}
-
-		req, err := http.NewRequest(r.Method, apmServerUrl, nil)
-		//forward every header received
-		for name, values := range r.Header {
-			// Loop over all values for the name.
-			for _, value := range values {
-				req.Header.Set(name, value)
+		// Send request to the apm server endpoints, in order, until one responds
+		destinations := apmServerEndpoints.destinations(config)
+		var serverResp *http.Response
+		for i, destination := range destinations {
+			resp, err := forwardInfoRequest(client, r, destination)
+			if err != nil {
+				log.Printf("error forwarding info request (`/`) to APM Server %s: %v", destination.url, err)
+				apmServerEndpoints.markFailing(destination.url)
+				continue
 			}
+			if resp.StatusCode >= 500 && i < len(destinations)-1 {
+				log.Printf("APM Server %s responded to info request (`/`) with status %d", destination.url, resp.StatusCode)
+				apmServerEndpoints.markFailing(destination.url)
+				resp.Body.Close()
+				continue
+			}
+			apmServerEndpoints.markHealthy(destination.url)
+			serverResp = resp
+			break
 		}
-		if err != nil {
-			log.Printf("could not create request object for %s:%s: %v", r.Method, apmServerUrl, err)
-			return
-		}
-
-		// Send request to apm server
-		serverResp, err := client.Do(req)
-		if err != nil {
-			log.Printf("error forwarding info request (`/`) to APM Server: %v", err)
+		if serverResp == nil {
 			return
 		}
+		defer serverResp.Body.Close()
 
 		// If WriteHeader is not called explicitly, the first call to Write
 		// will trigger an implicit WriteHeader(http.StatusOK).
@@ -71,7 +74,7 @@ func handleInfoRequest(apmServerUrl string) func(w http.ResponseWriter, r *http.
 		}
 
 		// copy body to request sent back to the agent
-		_, err = io.Copy(w, serverResp.Body)
+		_, err := io.Copy(w, serverResp.Body)
 		if err != nil {
 			log.Printf("could not read info request response to APM Server: %v", err)
 			return
@@ -79,31 +82,106 @@ func handleInfoRequest(apmServerUrl string) func(w http.ResponseWriter, r *http.
 	}
 }
 
+// forwardInfoRequest sends the agent's info request to an apm server endpoint
+func forwardInfoRequest(client *http.Client, r *http.Request, destination *apmServerDestination) (*http.Response, error) {
+	req, err := http.NewRequest(r.Method, destination.url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("could not create request object for %s:%s: %v", r.Method, destination.url, err)
+	}
+	//forward every header received
+	for name, values := range r.Header {
+		// Loop over all values for the name.
+		for _, value := range values {
+			req.Header.Set(name, value)
+		}
+	}
+	// The agent credentials are replaced by the signature of the extension
+	if destination.signer != nil {
+		if err := setAuthorizationHeader(req, destination, nil); err != nil {
+			return nil, fmt.Errorf("could not sign request for %s:%s: %v", r.Method, destination.url, err)
+		}
+	}
+	return client.Do(req)
+}
+
 // URL: http://server/intake/v2/events
-func handleIntakeV2Events(agentDataChan chan AgentData) func(w http.ResponseWriter, r *http.Request) {
+func handleIntakeV2Events(agentDataBuffer *AgentDataBuffer, config *extensionConfig) func(w http.ResponseWriter, r *http.Request) {
 
 	return func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusAccepted)
-		w.Write([]byte("ok"))
-
-		rawBytes, err := ioutil.ReadAll(r.Body)
 		defer r.Body.Close()
+		if config.maxIntakeBodyBytes > 0 && r.ContentLength > int64(config.maxIntakeBodyBytes) {
+			rejectAgentData(w, r, http.StatusRequestEntityTooLarge, []IntakeEventError{{Message: errIntakeBodyTooLarge.Error()}})
+			return
+		}
+		rawBytes, err := ioutil.ReadAll(newSizeLimitedReader(r.Body, config.maxIntakeBodyBytes))
+		if err == errIntakeBodyTooLarge {
+			rejectAgentData(w, r, http.StatusRequestEntityTooLarge, []IntakeEventError{{Message: err.Error()}})
+			return
+		}
 		if err != nil {
-			log.Println("Could not read bytes from agent request body")
+			log.Printf("Could not read bytes from agent request body: %v", err)
+			rejectAgentData(w, r, http.StatusBadRequest, []IntakeEventError{{Message: "could not read request body: " + err.Error()}})
 			return
 		}
 
-		if len(rawBytes) > 0 {
-			agentData := AgentData{
-				Data:            rawBytes,
-				ContentEncoding: r.Header.Get("Content-Encoding"),
+		validateAndBufferAgentData(w, r, agentDataBuffer, rawBytes, config)
+	}
+}
+
+// validateAndBufferAgentData buffers the valid events of the agent data. The
+// agent gets a 400 response listing the rejected lines if there are any, along
+// with the number of events accepted nonetheless.
+func validateAndBufferAgentData(w http.ResponseWriter, r *http.Request, agentDataBuffer *AgentDataBuffer, rawBytes []byte, config *extensionConfig) {
+	if len(rawBytes) > 0 {
+		agentData := AgentData{Data: rawBytes, ContentEncoding: r.Header.Get("Content-Encoding")}
+		if validData, accepted, errs := validateIntakeEvents(agentData); len(errs) > 0 {
+			if accepted > 0 && !addAgentData(w, r, agentDataBuffer, validData, config) {
+				return
 			}
-			log.Println("Adding agent data to buffer to be sent to apm server")
-			agentDataChan <- agentData
+			respondIntakeErrors(w, r, http.StatusBadRequest, intakeResponse{Accepted: accepted, Errors: errs})
+			return
 		}
+	}
+	bufferAgentData(w, r, agentDataBuffer, rawBytes, config)
+}
 
-		if len(r.URL.Query()["flushed"]) > 0 && r.URL.Query()["flushed"][0] == "true" {
-			AgentDoneSignal <- struct{}{}
+// bufferAgentData adds the agent data to the buffer, to be sent to the APM
+// server, and responds to the agent
+func bufferAgentData(w http.ResponseWriter, r *http.Request, agentDataBuffer *AgentDataBuffer, rawBytes []byte, config *extensionConfig) {
+	if len(rawBytes) > 0 {
+		agentData := AgentData{
+			Data:            rawBytes,
+			ContentEncoding: r.Header.Get("Content-Encoding"),
+		}
+		if !addAgentData(w, r, agentDataBuffer, agentData, config) {
+			return
 		}
 	}
+
+	w.WriteHeader(http.StatusAccepted)
+	w.Write([]byte("ok"))
+	signalAgentFlushed(r)
+}
+
+// addAgentData adds the agent data to the buffer and reports whether it was
+// added. Otherwise, the buffer is full and the agent is asked to retry later.
+func addAgentData(w http.ResponseWriter, r *http.Request, agentDataBuffer *AgentDataBuffer, agentData AgentData, config *extensionConfig) bool {
+	log.Println("Adding agent data to buffer to be sent to apm server")
+	// With the block policy, wait for room in the buffer for a limited time
+	// only, so that the agent gets a 503 rather than a timeout. With the
+	// drop_newest policy, dropped agent data is answered with a 202 all
+	// the same, so that agents do not retry it.
+	ctx := r.Context()
+	if config.agentDataBlockTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, config.agentDataBlockTimeout)
+		defer cancel()
+	}
+	if err := agentDataBuffer.Add(agentData, ctx.Done()); err != nil {
+		setRetryAfter(w, config.intakeRetryAfter)
+		rejectAgentData(w, r, http.StatusServiceUnavailable, []IntakeEventError{{Message: ErrBufferFull.Error()}})
+		return false
+	}
+	fanOut(agentData)
+	return true
 }
@@ -0,0 +1,217 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package extension
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	sigV4Algorithm  = "AWS4-HMAC-SHA256"
+	sigV4TimeFormat = "20060102T150405Z"
+	sigV4DateFormat = "20060102"
+)
+
+// awsCredentials are the credentials used to sign requests to AWS services
+type awsCredentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+}
+
+// awsCredentialsFromEnv returns the credentials of the function's execution
+// role, which Lambda provides through environment variables
+func awsCredentialsFromEnv() (awsCredentials, error) {
+	credentials := awsCredentials{
+		AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+	}
+	if credentials.AccessKeyID == "" || credentials.SecretAccessKey == "" {
+		return credentials, errors.New("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY are not set")
+	}
+	return credentials, nil
+}
+
+// sigV4Signer signs the requests to an APM server fronted by AWS IAM
+// authorization, such as API Gateway or a Lambda function URL, with the
+// credentials of the function's execution role
+type sigV4Signer struct {
+	service string
+	region  string
+	now     func() time.Time
+}
+
+func newSigV4Signer(service string, region string) *sigV4Signer {
+	return &sigV4Signer{service: service, region: region, now: time.Now}
+}
+
+// sign adds the signature of the request and its payload. The credentials
+// are read on each call, as Lambda updates them when the role session expires.
+func (s *sigV4Signer) sign(req *http.Request, payload []byte) error {
+	credentials, err := awsCredentialsFromEnv()
+	if err != nil {
+		return err
+	}
+	signRequestV4(req, hashSHA256(payload), credentials, s.region, s.service, s.now())
+	return nil
+}
+
+// hashSHA256 returns the hex encoded SHA-256 digest of the data, as used for
+// the payload hash of signed requests
+func hashSHA256(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// signRequestV4 adds the AWS Signature Version 4 headers to the request. The
+// payload hash is the hex encoded SHA-256 digest of the body. The host, the
+// content type and all the X-Amz-* headers are signed.
+func signRequestV4(req *http.Request, payloadHash string, credentials awsCredentials, region string, service string, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format(sigV4TimeFormat)
+	req.Header.Set("X-Amz-Date", amzDate)
+	if credentials.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", credentials.SessionToken)
+	}
+
+	canonicalHeaders, signedHeaders := canonicalHeadersV4(req)
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		canonicalURIV4(req, service),
+		canonicalQueryV4(req),
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := strings.Join([]string{now.Format(sigV4DateFormat), region, service, "aws4_request"}, "/")
+	stringToSign := strings.Join([]string{
+		sigV4Algorithm,
+		amzDate,
+		scope,
+		hashSHA256([]byte(canonicalRequest)),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+credentials.SecretAccessKey), now.Format(sigV4DateFormat))
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		sigV4Algorithm, credentials.AccessKeyID, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// canonicalURIV4 returns the path of the request as signed. Services other
+// than S3 expect each path segment to be encoded twice, that is the path as
+// sent is encoded once more.
+func canonicalURIV4(req *http.Request, service string) string {
+	path := req.URL.EscapedPath()
+	if path == "" {
+		return "/"
+	}
+	if service == "s3" {
+		return path
+	}
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		segments[i] = escapeV4(segment)
+	}
+	return strings.Join(segments, "/")
+}
+
+func canonicalQueryV4(req *http.Request) string {
+	query := req.URL.Query()
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var pairs []string
+	for _, key := range keys {
+		values := query[key]
+		sort.Strings(values)
+		for _, value := range values {
+			pairs = append(pairs, escapeV4(key)+"="+escapeV4(value))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+// escapeV4 percent-encodes everything but the unreserved characters of RFC 3986
+func escapeV4(value string) string {
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		if ('A' <= c && c <= 'Z') || ('a' <= c && c <= 'z') || ('0' <= c && c <= '9') ||
+			c == '-' || c == '_' || c == '.' || c == '~' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func canonicalHeadersV4(req *http.Request) (string, string) {
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	headers := map[string]string{"host": host}
+	for name, values := range req.Header {
+		name = strings.ToLower(name)
+		if name != "content-type" && !strings.HasPrefix(name, "x-amz-") {
+			continue
+		}
+		trimmed := make([]string, len(values))
+		for i, value := range values {
+			trimmed[i] = strings.Join(strings.Fields(value), " ")
+		}
+		headers[name] = strings.Join(trimmed, ",")
+	}
+
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonical strings.Builder
+	for _, name := range names {
+		canonical.WriteString(name + ":" + headers[name] + "\n")
+	}
+	return canonical.String(), strings.Join(names, ";")
+}
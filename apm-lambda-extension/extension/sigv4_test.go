@@ -0,0 +1,171 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package extension
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+)
+
+// The expected signatures come from the examples of the AWS Signature
+// Version 4 documentation and test suite
+var testAwsCredentials = awsCredentials{
+	AccessKeyID:     "AKIDEXAMPLE",
+	SecretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY",
+}
+
+var testSigningTime = time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC)
+
+func TestSignRequestV4(t *testing.T) {
+	req, _ := http.NewRequest("GET", "https://example.amazonaws.com/", nil)
+	signRequestV4(req, hashSHA256(nil), testAwsCredentials, "us-east-1", "service", testSigningTime)
+
+	assert.Equal(t, "20150830T123600Z", req.Header.Get("X-Amz-Date"))
+	assert.Equal(t, "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, "+
+		"SignedHeaders=host;x-amz-date, "+
+		"Signature=5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31",
+		req.Header.Get("Authorization"))
+}
+
+func TestSignRequestV4WithQueryAndContentType(t *testing.T) {
+	req, _ := http.NewRequest("GET", "https://iam.amazonaws.com/?Action=ListUsers&Version=2010-05-08", nil)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+	signRequestV4(req, hashSHA256(nil), testAwsCredentials, "us-east-1", "iam", testSigningTime)
+
+	assert.Equal(t, "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/iam/aws4_request, "+
+		"SignedHeaders=content-type;host;x-amz-date, "+
+		"Signature=5d672d79c15b13162d9279b0855cfba6789a8edb4c82c400e06b5924a6f2b5d7",
+		req.Header.Get("Authorization"))
+}
+
+func TestSignRequestV4WithSessionToken(t *testing.T) {
+	credentials := testAwsCredentials
+	credentials.SessionToken = "token"
+	req, _ := http.NewRequest("POST", "https://example.amazonaws.com/", nil)
+	signRequestV4(req, hashSHA256([]byte("{}")), credentials, "us-east-1", "service", testSigningTime)
+
+	assert.Equal(t, "token", req.Header.Get("X-Amz-Security-Token"))
+	assert.Assert(t, strings.Contains(req.Header.Get("Authorization"), "SignedHeaders=host;x-amz-date;x-amz-security-token,"))
+}
+
+func TestSignRequestV4WithEscapedPath(t *testing.T) {
+	// The signature was computed separately, following the documentation
+	req, _ := http.NewRequest("GET", "https://abc123.execute-api.us-east-1.amazonaws.com/prod/documents/example%20space/a%2Fb", nil)
+	signRequestV4(req, hashSHA256(nil), testAwsCredentials, "us-east-1", "execute-api", testSigningTime)
+
+	assert.Equal(t, "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/execute-api/aws4_request, "+
+		"SignedHeaders=host;x-amz-date, "+
+		"Signature=6e92b3910ff1a73b174591e4975ba1e820cbba918c5cdae105d8553ae1d15cb6",
+		req.Header.Get("Authorization"))
+}
+
+func TestCanonicalURIV4(t *testing.T) {
+	tests := []struct {
+		url       string
+		service   string
+		canonical string
+	}{
+		{"https://example.amazonaws.com", "execute-api", "/"},
+		{"https://example.amazonaws.com/intake/v2/events", "execute-api", "/intake/v2/events"},
+		{"https://example.amazonaws.com/example%20space/a%2Fb", "execute-api", "/example%2520space/a%252Fb"},
+		{"https://example.amazonaws.com/example%20space/a%2Fb", "s3", "/example%20space/a%2Fb"},
+	}
+	for _, test := range tests {
+		req, _ := http.NewRequest("GET", test.url, nil)
+		assert.Equal(t, test.canonical, canonicalURIV4(req, test.service), test.url)
+	}
+}
+
+func TestEscapeV4(t *testing.T) {
+	assert.Equal(t, "a-b_c.d~e%20f%2Fg%3D", escapeV4("a-b_c.d~e f/g="))
+}
+
+// verifySigV4 signs the received request again, with the same time and the
+// body as received, and checks that the signatures match
+func verifySigV4(t *testing.T, r *http.Request, region string, service string) {
+	body, _ := ioutil.ReadAll(r.Body)
+	signedAt, err := time.Parse(sigV4TimeFormat, r.Header.Get("X-Amz-Date"))
+	assert.NilError(t, err)
+
+	expected, _ := http.NewRequest(r.Method, "http://"+r.Host+r.URL.RequestURI(), nil)
+	for name, values := range r.Header {
+		if name == "Content-Type" || strings.HasPrefix(name, "X-Amz-") {
+			expected.Header[name] = values
+		}
+	}
+	credentials, err := awsCredentialsFromEnv()
+	assert.NilError(t, err)
+	signRequestV4(expected, hashSHA256(body), credentials, region, service, signedAt)
+	assert.Equal(t, expected.Header.Get("Authorization"), r.Header.Get("Authorization"))
+}
+
+func TestPostToApmServerSigV4(t *testing.T) {
+	defer setAwsCredentialsEnv()()
+	var signed bool
+	apmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Assert(t, strings.Contains(r.Header.Get("Authorization"), "/eu-west-1/execute-api/aws4_request"))
+		assert.Equal(t, "session", r.Header.Get("X-Amz-Security-Token"))
+		verifySigV4(t, r, "eu-west-1", "execute-api")
+		signed = true
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer apmServer.Close()
+
+	config := extensionConfig{
+		apmServerUrl:         apmServer.URL + "/",
+		apmServerSecretToken: "unused",
+		sigV4Signer:          newSigV4Signer("execute-api", "eu-west-1"),
+	}
+	err := PostToApmServer(context.Background(), apmServer.Client(), AgentData{Data: []byte("foo")}, &config)
+	assert.NilError(t, err)
+	assert.Assert(t, signed)
+}
+
+func TestInfoRequestSigV4(t *testing.T) {
+	defer setAwsCredentialsEnv()()
+	apmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Assert(t, strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 "))
+		verifySigV4(t, r, "us-east-1", "lambda")
+		w.Write([]byte(`{"version": "7.15.0"}`))
+	}))
+	defer apmServer.Close()
+
+	config := extensionConfig{
+		apmServerUrl: apmServer.URL + "/",
+		sigV4Signer:  newSigV4Signer("lambda", "us-east-1"),
+	}
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Authorization", "Bearer agent-token")
+	recorder := httptest.NewRecorder()
+	handleInfoRequest(apmServer.Client(), &config)(recorder, req)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, `{"version": "7.15.0"}`, recorder.Body.String())
+}
+
+func TestSigV4SignerWithoutCredentials(t *testing.T) {
+	req, _ := http.NewRequest("GET", "https://example.amazonaws.com/", nil)
+	err := newSigV4Signer("execute-api", "us-east-1").sign(req, nil)
+	assert.ErrorContains(t, err, "AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY are not set")
+}
@@ -0,0 +1,230 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package extension
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	spoolFileExtension = ".spool"
+	// spoolTempExtension marks entries that are still being written
+	spoolTempExtension = spoolFileExtension + ".tmp"
+)
+
+// agentDataSpool holds agent data that could not be sent to the APM server.
+// It is nil when spooling is disabled.
+var agentDataSpool *Spool
+
+// Spool persists agent data that could not be delivered to the APM server in a
+// directory on disk, so it can be replayed on a later invocation. Entries are
+// stored one per file, named after a sequence number that preserves their
+// order, which lets the spool pick up where it left off if the extension
+// process is restarted within the same sandbox.
+// Once the spool reaches its size limit, the oldest entries are evicted.
+type Spool struct {
+	sync.Mutex
+	dir      string
+	maxBytes int64
+	size     int64
+	entries  []spoolEntry
+	nextSeq  uint64
+}
+
+type spoolEntry struct {
+	seq  uint64
+	size int64
+}
+
+// InitSpool opens the spool configured in the extension config. Spooling stays
+// disabled when no size limit is configured.
+func InitSpool(config *extensionConfig) error {
+	if config.spoolMaxBytes <= 0 {
+		return nil
+	}
+	spool, err := OpenSpool(config.spoolDir, config.spoolMaxBytes)
+	if err != nil {
+		return err
+	}
+	agentDataSpool = spool
+	log.Printf("Spooling undelivered agent data to %s, %d entries found", spool.dir, spool.Len())
+	return nil
+}
+
+// OpenSpool opens the spool in dir, creating the directory if needed and
+// loading any entries left behind by a previous extension process.
+func OpenSpool(dir string, maxBytes int64) (*Spool, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("could not create spool directory %s: %v", dir, err)
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("could not read spool directory %s: %v", dir, err)
+	}
+
+	s := &Spool{dir: dir, maxBytes: maxBytes}
+	for _, f := range files {
+		name := f.Name()
+		if strings.HasSuffix(name, spoolTempExtension) {
+			// Leftover of an interrupted write
+			os.Remove(filepath.Join(dir, name))
+			continue
+		}
+		// Leave files that are not spool entries alone, the directory may
+		// be shared
+		if !strings.HasSuffix(name, spoolFileExtension) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, spoolFileExtension), 10, 64)
+		if err != nil {
+			continue
+		}
+		s.entries = append(s.entries, spoolEntry{seq: seq, size: f.Size()})
+		s.size += f.Size()
+		if seq >= s.nextSeq {
+			s.nextSeq = seq + 1
+		}
+	}
+	sort.Slice(s.entries, func(i, j int) bool { return s.entries[i].seq < s.entries[j].seq })
+	s.evict()
+	return s, nil
+}
+
+// Push appends agent data to the spool, evicting the oldest entries if needed
+// to stay within the size limit. Entries are only evicted once the new entry
+// is written, so that nothing is lost when writing it fails.
+func (s *Spool) Push(agentData AgentData) error {
+	var buf bytes.Buffer
+	buf.WriteString(agentData.ContentEncoding)
+	buf.WriteByte('\n')
+	buf.Write(agentData.Data)
+	size := int64(buf.Len())
+	if size > s.maxBytes {
+		return fmt.Errorf("agent data of %d bytes exceeds the spool size limit of %d bytes", size, s.maxBytes)
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	seq := s.nextSeq
+	path := s.path(seq)
+	// Write to a temporary file first, so that a partially written
+	// entry is never picked up after a restart
+	tmpPath := filepath.Join(s.dir, fmt.Sprintf("%020d%s", seq, spoolTempExtension))
+	if err := ioutil.WriteFile(tmpPath, buf.Bytes(), 0600); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("could not write spool entry: %v", err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("could not write spool entry: %v", err)
+	}
+	s.nextSeq++
+	s.entries = append(s.entries, spoolEntry{seq: seq, size: size})
+	s.size += size
+	s.evict()
+	return nil
+}
+
+// Peek returns the oldest entry of the spool without removing it.
+// Entries that cannot be read are discarded.
+func (s *Spool) Peek() (AgentData, bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	for len(s.entries) > 0 {
+		agentData, err := s.read(s.entries[0].seq)
+		if err == nil {
+			return agentData, true
+		}
+		log.Printf("Discarding unreadable spool entry: %v", err)
+		s.removeOldest()
+	}
+	return AgentData{}, false
+}
+
+// Pop removes the oldest entry from the spool
+func (s *Spool) Pop() {
+	s.Lock()
+	defer s.Unlock()
+
+	if len(s.entries) > 0 {
+		s.removeOldest()
+	}
+}
+
+// Len returns the number of entries in the spool
+func (s *Spool) Len() int {
+	s.Lock()
+	defer s.Unlock()
+	return len(s.entries)
+}
+
+// Size returns the number of bytes used by the spool
+func (s *Spool) Size() int64 {
+	s.Lock()
+	defer s.Unlock()
+	return s.size
+}
+
+// evict removes the oldest entries until the spool is within its size limit.
+// The lock must be held.
+func (s *Spool) evict() {
+	for len(s.entries) > 1 && s.size > s.maxBytes {
+		log.Printf("Spool is full, evicting oldest entry of %d bytes", s.entries[0].size)
+		s.removeOldest()
+	}
+}
+
+// removeOldest deletes the oldest entry. The lock must be held.
+func (s *Spool) removeOldest() {
+	entry := s.entries[0]
+	if err := os.Remove(s.path(entry.seq)); err != nil && !os.IsNotExist(err) {
+		log.Printf("Could not remove spool entry: %v", err)
+	}
+	s.entries = s.entries[1:]
+	s.size -= entry.size
+}
+
+func (s *Spool) read(seq uint64) (AgentData, error) {
+	content, err := ioutil.ReadFile(s.path(seq))
+	if err != nil {
+		return AgentData{}, err
+	}
+	headerEnd := bytes.IndexByte(content, '\n')
+	if headerEnd < 0 {
+		return AgentData{}, fmt.Errorf("spool entry %d has no header", seq)
+	}
+	return AgentData{
+		Data:            content[headerEnd+1:],
+		ContentEncoding: string(content[:headerEnd]),
+	}, nil
+}
+
+func (s *Spool) path(seq uint64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%020d%s", seq, spoolFileExtension))
+}
@@ -0,0 +1,208 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package extension
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+func TestSpoolKeepsOrderAcrossRestarts(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "spool")
+	defer os.RemoveAll(dir)
+
+	spool, err := OpenSpool(dir, 1024)
+	assert.NilError(t, err)
+	assert.NilError(t, spool.Push(AgentData{Data: []byte("first"), ContentEncoding: "gzip"}))
+	assert.NilError(t, spool.Push(AgentData{Data: []byte("second")}))
+
+	// Reopen the spool, as a restarted extension process would
+	spool, err = OpenSpool(dir, 1024)
+	assert.NilError(t, err)
+	assert.NilError(t, spool.Push(AgentData{Data: []byte("third")}))
+	assert.Equal(t, 3, spool.Len())
+
+	for _, want := range []AgentData{
+		{Data: []byte("first"), ContentEncoding: "gzip"},
+		{Data: []byte("second")},
+		{Data: []byte("third")},
+	} {
+		agentData, ok := spool.Peek()
+		assert.Assert(t, ok)
+		assert.Equal(t, string(want.Data), string(agentData.Data))
+		assert.Equal(t, want.ContentEncoding, agentData.ContentEncoding)
+		spool.Pop()
+	}
+	_, ok := spool.Peek()
+	assert.Assert(t, !ok)
+	assert.Equal(t, int64(0), spool.Size())
+}
+
+func TestSpoolEvictsOldestEntries(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "spool")
+	defer os.RemoveAll(dir)
+
+	// Each entry takes 6 bytes: the empty encoding header and 5 bytes of data
+	spool, err := OpenSpool(dir, 12)
+	assert.NilError(t, err)
+	assert.NilError(t, spool.Push(AgentData{Data: []byte("aaaaa")}))
+	assert.NilError(t, spool.Push(AgentData{Data: []byte("bbbbb")}))
+	assert.NilError(t, spool.Push(AgentData{Data: []byte("ccccc")}))
+	assert.Equal(t, 2, spool.Len())
+
+	agentData, _ := spool.Peek()
+	assert.Equal(t, "bbbbb", string(agentData.Data))
+
+	// Data that can never fit is rejected
+	assert.Assert(t, spool.Push(AgentData{Data: []byte("this is far too long")}) != nil)
+	assert.Equal(t, 2, spool.Len())
+}
+
+func TestSpoolIgnoresInterruptedWrites(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "spool")
+	defer os.RemoveAll(dir)
+
+	ioutil.WriteFile(filepath.Join(dir, "00000000000000000007.spool.tmp"), []byte("\npartial"), 0600)
+	ioutil.WriteFile(filepath.Join(dir, "notes.txt"), []byte("not a spool entry"), 0600)
+	spool, err := OpenSpool(dir, 1024)
+	assert.NilError(t, err)
+	assert.Equal(t, 0, spool.Len())
+
+	// Only the leftovers of the spool are removed from the directory
+	files, _ := ioutil.ReadDir(dir)
+	assert.Equal(t, 1, len(files))
+	assert.Equal(t, "notes.txt", files[0].Name())
+}
+
+func TestSpoolKeepsEntriesWhenWriteFails(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "spool")
+	defer os.RemoveAll(dir)
+
+	spool, err := OpenSpool(dir, 12)
+	assert.NilError(t, err)
+	assert.NilError(t, spool.Push(AgentData{Data: []byte("aaaaa")}))
+	assert.NilError(t, spool.Push(AgentData{Data: []byte("bbbbb")}))
+
+	// Block the temporary file of the next entry, so that writing it fails
+	assert.NilError(t, os.Mkdir(filepath.Join(dir, "00000000000000000002.spool.tmp"), 0700))
+	assert.Assert(t, spool.Push(AgentData{Data: []byte("ccccc")}) != nil)
+
+	// The spool was full, but no entry was evicted for the failed write
+	assert.Equal(t, 2, spool.Len())
+	agentData, _ := spool.Peek()
+	assert.Equal(t, "aaaaa", string(agentData.Data))
+}
+
+func TestReplaySpool(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "spool")
+	defer os.RemoveAll(dir)
+	defer func() { agentDataSpool = nil }()
+
+	var received []string
+	apmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		received = append(received, string(body))
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer apmServer.Close()
+
+	config := extensionConfig{
+		apmServerUrl:  apmServer.URL + "/",
+		spoolDir:      dir,
+		spoolMaxBytes: 1024,
+	}
+	assert.NilError(t, InitSpool(&config))
+
+	// Data that fails to send ends up in the spool
+	HandleSendFailure(AgentData{Data: []byte("first"), ContentEncoding: "identity"}, errCircuitOpen)
+	HandleSendFailure(AgentData{Data: []byte("second"), ContentEncoding: "identity"}, errCircuitOpen)
+	assert.Equal(t, 2, agentDataSpool.Len())
+
+	assert.Assert(t, ReplaySpool(context.Background(), apmServer.Client(), &config))
+	assert.Equal(t, 0, agentDataSpool.Len())
+	assert.DeepEqual(t, []string{"first", "second"}, received)
+}
+
+func TestSpoolAgentDataOnShutdown(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "spool")
+	defer os.RemoveAll(dir)
+	defer func() { agentDataSpool = nil }()
+
+	config := extensionConfig{spoolDir: dir, spoolMaxBytes: 1024}
+	assert.NilError(t, InitSpool(&config))
+
+	dataBuffer := NewAgentDataBuffer(100, 0, OverflowBlock)
+	dataBuffer.Add(AgentData{Data: []byte("first")}, nil)
+	dataBuffer.Add(AgentData{Data: []byte("second")}, nil)
+	SpoolAgentData(dataBuffer, ErrShuttingDown)
+
+	assert.Equal(t, 0, dataBuffer.Len())
+	assert.Equal(t, 2, agentDataSpool.Len())
+	agentData, _ := agentDataSpool.Peek()
+	assert.Equal(t, "first", string(agentData.Data))
+}
+
+func TestNewAgentDataIsSpooledBehindUnreplayedData(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "spool")
+	defer os.RemoveAll(dir)
+	defer func() { agentDataSpool = nil }()
+	defer func() { apmServerEndpoints = newEndpointPool() }()
+
+	var available int32
+	var received []string
+	apmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&available) == 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		received = append(received, string(body))
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer apmServer.Close()
+
+	config := extensionConfig{
+		apmServerUrl:  apmServer.URL + "/",
+		spoolDir:      dir,
+		spoolMaxBytes: 1024,
+	}
+	assert.NilError(t, InitSpool(&config))
+	HandleSendFailure(AgentData{Data: []byte("spooled"), ContentEncoding: "identity"}, errCircuitOpen)
+
+	// The replay fails, new agent data is spooled behind the spooled data
+	// rather than sent ahead of it
+	assert.Assert(t, !ReplaySpool(context.Background(), apmServer.Client(), &config))
+	dataBuffer := NewAgentDataBuffer(100, 0, OverflowBlock)
+	dataBuffer.Add(AgentData{Data: []byte("buffered"), ContentEncoding: "identity"}, nil)
+	SpoolAgentData(dataBuffer, ErrSpoolNotReplayed, AgentData{Data: []byte("received"), ContentEncoding: "identity"})
+	assert.Equal(t, 0, dataBuffer.Len())
+	assert.Equal(t, 0, len(received))
+
+	// Once the APM server is available, all of it is replayed in order
+	atomic.StoreInt32(&available, 1)
+	assert.Assert(t, ReplaySpool(context.Background(), apmServer.Client(), &config))
+	assert.DeepEqual(t, []string{"spooled", "received", "buffered"}, received)
+}
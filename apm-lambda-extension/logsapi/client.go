@@ -24,13 +24,25 @@ import (
 	"io/ioutil"
 	"log"
 	"net/http"
+	"strings"
 
 	"github.com/pkg/errors"
 )
 
 const lambdaAgentIdentifierHeaderKey string = "Lambda-Extension-Identifier"
 
-// Client is the client used to subscribe to the Logs API
+// SubscriptionAPI is the Lambda API used to subscribe to the log and platform events
+type SubscriptionAPI string
+
+const (
+	// TelemetryAPI is the Lambda Telemetry API, falling back to the Logs API
+	// where it is not available
+	TelemetryAPI SubscriptionAPI = "telemetry"
+	// LogsAPI is the Lambda Logs API, superseded by the Telemetry API
+	LogsAPI SubscriptionAPI = "logs"
+)
+
+// Client is the client used to subscribe to the Logs API or the Telemetry API
 type Client struct {
 	httpClient     *http.Client
 	logsAPIBaseUrl string
@@ -62,6 +74,14 @@ const (
 	// RuntimeDone event is sent when lambda function is finished it's execution
 	RuntimeDone SubEventType = "platform.runtimeDone"
 	Fault       SubEventType = "platform.fault"
+	// PlatformStart event is sent when lambda function starts an invocation
+	PlatformStart SubEventType = "platform.start"
+	// PlatformReport event is sent with the metrics of an invocation, once it is finished
+	PlatformReport SubEventType = "platform.report"
+	// PlatformInitStart event is sent by the Telemetry API when the function initialization starts
+	PlatformInitStart SubEventType = "platform.initStart"
+	// PlatformInitReport event is sent by the Telemetry API with the metrics of the function initialization
+	PlatformInitReport SubEventType = "platform.initReport"
 )
 
 // BufferingCfg is the configuration set for receiving logs from Logs API. Whichever of the conditions below is met first, the logs will be sent
@@ -70,10 +90,59 @@ type BufferingCfg struct {
 	MaxItems uint32 `json:"maxItems"`
 	// MaxBytes is the maximum size in bytes of the logs to be buffered in memory. (default: 262144, minimum: 262144, maximum: 1048576)
 	MaxBytes uint32 `json:"maxBytes"`
-	// TimeoutMS is the maximum time (in milliseconds) for a batch to be buffered. (default: 1000, minimum: 100, maximum: 30000)
+	// TimeoutMS is the maximum time (in milliseconds) for a batch to be buffered. (default: 1000, minimum: 25, maximum: 30000)
 	TimeoutMS uint32 `json:"timeoutMs"`
 }
 
+// DefaultBufferingCfg favours a low latency of the events over the overhead of receiving them
+var DefaultBufferingCfg = BufferingCfg{
+	MaxItems:  10000,
+	MaxBytes:  262144,
+	TimeoutMS: 25,
+}
+
+// Validate checks the buffering configuration against the limits of the Logs API
+func (b BufferingCfg) Validate() error {
+	if b.MaxItems < 1000 || b.MaxItems > 10000 {
+		return errors.Errorf("maxItems %d is out of range, it must be between 1000 and 10000", b.MaxItems)
+	}
+	if b.MaxBytes < 262144 || b.MaxBytes > 1048576 {
+		return errors.Errorf("maxBytes %d is out of range, it must be between 262144 and 1048576", b.MaxBytes)
+	}
+	if b.TimeoutMS < 25 || b.TimeoutMS > 30000 {
+		return errors.Errorf("timeoutMs %d is out of range, it must be between 25 and 30000", b.TimeoutMS)
+	}
+	return nil
+}
+
+// ParseEventTypes parses a comma separated list of event types. The platform
+// events are required to follow the invocations, and the extension logs can
+// not be subscribed to, as logging them would produce more extension logs.
+func ParseEventTypes(value string) ([]EventType, error) {
+	var types []EventType
+	seen := make(map[EventType]bool)
+	for _, name := range strings.Split(value, ",") {
+		eventType := EventType(strings.ToLower(strings.TrimSpace(name)))
+		switch eventType {
+		case "":
+			continue
+		case Platform, Function:
+		case Extension:
+			return nil, errors.New("extension logs can not be subscribed to")
+		default:
+			return nil, errors.Errorf("unknown event type %q", eventType)
+		}
+		if !seen[eventType] {
+			seen[eventType] = true
+			types = append(types, eventType)
+		}
+	}
+	if !seen[Platform] {
+		return nil, errors.Errorf("the %s event type is required", Platform)
+	}
+	return types, nil
+}
+
 // URI is used to set the endpoint where the logs will be sent to
 type URI string
 
@@ -92,6 +161,8 @@ type HttpProtocol string
 
 const (
 	HttpProto HttpProtocol = "HTTP"
+	// TcpProto streams the events as newline-delimited JSON over TCP
+	TcpProto HttpProtocol = "TCP"
 )
 
 // HttpEncoding denotes what the content is encoded in
@@ -101,12 +172,13 @@ const (
 	JSON HttpEncoding = "JSON"
 )
 
-// Destination is the configuration for listeners who would like to receive logs with HTTP
+// Destination is the configuration for listeners who would like to receive logs with HTTP.
+// The Telemetry API only takes the protocol and URI.
 type Destination struct {
 	Protocol   HttpProtocol `json:"protocol"`
 	URI        URI          `json:"URI"`
-	HttpMethod HttpMethod   `json:"method"`
-	Encoding   HttpEncoding `json:"encoding"`
+	HttpMethod HttpMethod   `json:"method,omitempty"`
+	Encoding   HttpEncoding `json:"encoding,omitempty"`
 }
 
 type SchemaVersion string
@@ -114,6 +186,8 @@ type SchemaVersion string
 const (
 	SchemaVersion20210318 = "2021-03-18"
 	SchemaVersionLatest   = SchemaVersion20210318
+	// SchemaVersion20220701 is the schema version of the Telemetry API
+	SchemaVersion20220701 = "2022-07-01"
 )
 
 // SubscribeRequest is the request body that is sent to Logs API on subscribe
@@ -131,10 +205,19 @@ type SubscribeResponse struct {
 
 // Subscribe calls the Logs API to subscribe for the log events.
 func (c *Client) Subscribe(types []EventType, bufferingCfg BufferingCfg, destination Destination, extensionId string) (*SubscribeResponse, error) {
+	return c.subscribe("Logs API", "2020-08-15/logs", SchemaVersionLatest, types, bufferingCfg, destination, extensionId)
+}
+
+// SubscribeTelemetry calls the Telemetry API to subscribe for the telemetry events.
+func (c *Client) SubscribeTelemetry(types []EventType, bufferingCfg BufferingCfg, destination Destination, extensionId string) (*SubscribeResponse, error) {
+	return c.subscribe("Telemetry API", "2022-07-01/telemetry", SchemaVersion20220701, types, bufferingCfg, destination, extensionId)
+}
+
+func (c *Client) subscribe(apiName string, path string, schemaVersion SchemaVersion, types []EventType, bufferingCfg BufferingCfg, destination Destination, extensionId string) (*SubscribeResponse, error) {
 
 	data, err := json.Marshal(
 		&SubscribeRequest{
-			SchemaVersion: SchemaVersionLatest,
+			SchemaVersion: schemaVersion,
 			EventTypes:    types,
 			BufferingCfg:  bufferingCfg,
 			Destination:   destination,
@@ -145,7 +228,7 @@ func (c *Client) Subscribe(types []EventType, bufferingCfg BufferingCfg, destina
 
 	headers := make(map[string]string)
 	headers[lambdaAgentIdentifierHeaderKey] = extensionId
-	url := fmt.Sprintf("%s/2020-08-15/logs", c.logsAPIBaseUrl)
+	url := fmt.Sprintf("%s/%s", c.logsAPIBaseUrl, path)
 	resp, err := httpPutWithHeaders(c.httpClient, url, data, &headers)
 	if err != nil {
 		return nil, err
@@ -153,8 +236,8 @@ func (c *Client) Subscribe(types []EventType, bufferingCfg BufferingCfg, destina
 	defer resp.Body.Close()
 
 	if resp.StatusCode == http.StatusAccepted {
-		log.Println("Logs API is not supported. Is this extension running in a local sandbox?")
-		return nil, errors.Errorf("Logs API is not supported in this environment")
+		log.Printf("%s is not supported. Is this extension running in a local sandbox?", apiName)
+		return nil, errors.Errorf("%s is not supported in this environment", apiName)
 	} else if resp.StatusCode != http.StatusOK {
 		body, err := ioutil.ReadAll(resp.Body)
 		if err != nil {
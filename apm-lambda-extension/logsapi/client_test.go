@@ -0,0 +1,63 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package logsapi
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBufferingCfgValidate(t *testing.T) {
+	assert.NoError(t, DefaultBufferingCfg.Validate())
+	assert.NoError(t, BufferingCfg{MaxItems: 1000, MaxBytes: 1048576, TimeoutMS: 30000}.Validate())
+
+	tests := []struct {
+		bufferingCfg BufferingCfg
+		err          string
+	}{
+		{BufferingCfg{MaxItems: 999, MaxBytes: 262144, TimeoutMS: 25}, "maxItems 999 is out of range, it must be between 1000 and 10000"},
+		{BufferingCfg{MaxItems: 10001, MaxBytes: 262144, TimeoutMS: 25}, "maxItems 10001 is out of range, it must be between 1000 and 10000"},
+		{BufferingCfg{MaxItems: 1000, MaxBytes: 262143, TimeoutMS: 25}, "maxBytes 262143 is out of range, it must be between 262144 and 1048576"},
+		{BufferingCfg{MaxItems: 1000, MaxBytes: 1048577, TimeoutMS: 25}, "maxBytes 1048577 is out of range, it must be between 262144 and 1048576"},
+		{BufferingCfg{MaxItems: 1000, MaxBytes: 262144, TimeoutMS: 24}, "timeoutMs 24 is out of range, it must be between 25 and 30000"},
+		{BufferingCfg{MaxItems: 1000, MaxBytes: 262144, TimeoutMS: 30001}, "timeoutMs 30001 is out of range, it must be between 25 and 30000"},
+	}
+	for _, test := range tests {
+		assert.EqualError(t, test.bufferingCfg.Validate(), test.err)
+	}
+}
+
+func TestParseEventTypes(t *testing.T) {
+	eventTypes, err := ParseEventTypes("platform")
+	assert.NoError(t, err)
+	assert.Equal(t, []EventType{Platform}, eventTypes)
+
+	eventTypes, err = ParseEventTypes(" Function, platform,function ")
+	assert.NoError(t, err)
+	assert.Equal(t, []EventType{Function, Platform}, eventTypes)
+
+	_, err = ParseEventTypes("function")
+	assert.EqualError(t, err, "the platform event type is required")
+
+	_, err = ParseEventTypes("platform,extension")
+	assert.EqualError(t, err, "extension logs can not be subscribed to")
+
+	_, err = ParseEventTypes("platform,foo")
+	assert.EqualError(t, err, `unknown event type "foo"`)
+}
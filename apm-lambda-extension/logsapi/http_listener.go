@@ -37,8 +37,47 @@ type LogEvent struct {
 }
 
 type LogEventRecord struct {
-	RequestId string `json:"requestId"`
-	Status    string `json:"status"`
+	RequestId string          `json:"requestId"`
+	Status    string          `json:"status"`
+	Metrics   PlatformMetrics `json:"metrics"`
+	// Spans break down the runtimeDone events of the Telemetry API
+	Spans []PlatformSpan `json:"spans"`
+	// Tracing is the tracing context of the invocation, sent by the Telemetry API
+	Tracing *PlatformTracing `json:"tracing"`
+	// InitializationType, Phase and RuntimeVersion are set on the
+	// platform.initStart events of the Telemetry API
+	InitializationType string `json:"initializationType"`
+	Phase              string `json:"phase"`
+	RuntimeVersion     string `json:"runtimeVersion"`
+}
+
+// PlatformSpan is a phase of the invocation, as reported by the Telemetry API
+type PlatformSpan struct {
+	Name       string    `json:"name"`
+	Start      time.Time `json:"start"`
+	DurationMs float64   `json:"durationMs"`
+}
+
+// PlatformTracing is the tracing context of the invocation, as reported by
+// the Telemetry API
+type PlatformTracing struct {
+	SpanId string `json:"spanId"`
+	Type   string `json:"type"`
+	Value  string `json:"value"`
+}
+
+// PlatformMetrics are the metrics of an invocation, as reported by the
+// platform.report event
+type PlatformMetrics struct {
+	DurationMs       float64 `json:"durationMs"`
+	BilledDurationMs int     `json:"billedDurationMs"`
+	MemorySizeMB     int     `json:"memorySizeMB"`
+	MaxMemoryUsedMB  int     `json:"maxMemoryUsedMB"`
+	// InitDurationMs is only reported for the first invocation of an
+	// execution environment
+	InitDurationMs float64 `json:"initDurationMs"`
+	// ProducedBytes is reported by the runtimeDone events of the Telemetry API
+	ProducedBytes int `json:"producedBytes"`
 }
 
 // LogsAPIHttpListener is used to listen to the Logs API using HTTP
@@ -115,7 +154,12 @@ func (h *LogsAPIHttpListener) http_handler(w http.ResponseWriter, r *http.Reques
 	}
 }
 
+// unmarshalRecord decodes the record of platform events. The records of
+// function and extension logs are the log lines, and are left as they are.
 func (le *LogEvent) unmarshalRecord() error {
+	if EventType(le.Type) == Function || EventType(le.Type) == Extension {
+		return nil
+	}
 	if SubEventType(le.Type) != Fault {
 		record := LogEventRecord{}
 		err := json.Unmarshal([]byte(le.RawRecord), &record)
@@ -21,6 +21,7 @@ import (
 	"encoding/json"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -115,3 +116,139 @@ func Test_unmarshalRecordError(t *testing.T) {
 	err = le.unmarshalRecord()
 	assert.Error(t, err)
 }
+
+func Test_unmarshalFunctionRecordString(t *testing.T) {
+	jsonBytes := []byte(`
+	{
+		"time": "2021-10-20T08:13:03.278Z",
+		"type": "function",
+		"record": "2021-10-20T08:13:03.278Z\t61c0fdeb-f013-4f2a-b627-56278f5666b8\tINFO\tHello world\n"
+	}
+	`)
+
+	var le LogEvent
+	err := json.Unmarshal(jsonBytes, &le)
+	if err != nil {
+		t.Fail()
+	}
+
+	err = le.unmarshalRecord()
+	assert.NoError(t, err)
+	assert.Equal(t, LogEventRecord{}, le.Record)
+}
+
+func Test_unmarshalReportRecord(t *testing.T) {
+	jsonBytes := []byte(`
+	{
+		"time": "2021-10-20T08:13:03.278Z",
+		"type": "platform.report",
+		"record": {
+			"requestId": "61c0fdeb-f013-4f2a-b627-56278f5666b8",
+			"metrics": {
+				"durationMs": 101.51,
+				"billedDurationMs": 300,
+				"memorySizeMB": 512,
+				"maxMemoryUsedMB": 33,
+				"initDurationMs": 116.67
+			}
+		}
+	}
+	`)
+
+	var le LogEvent
+	err := json.Unmarshal(jsonBytes, &le)
+	if err != nil {
+		t.Fail()
+	}
+
+	err = le.unmarshalRecord()
+	assert.NoError(t, err)
+
+	record := LogEventRecord{
+		RequestId: "61c0fdeb-f013-4f2a-b627-56278f5666b8",
+		Metrics: PlatformMetrics{
+			DurationMs:       101.51,
+			BilledDurationMs: 300,
+			MemorySizeMB:     512,
+			MaxMemoryUsedMB:  33,
+			InitDurationMs:   116.67,
+		},
+	}
+	assert.Equal(t, record, le.Record)
+}
+
+func Test_unmarshalTelemetryRuntimeDoneRecord(t *testing.T) {
+	jsonBytes := []byte(`
+	{
+		"time": "2022-10-12T00:01:15.000Z",
+		"type": "platform.runtimeDone",
+		"record": {
+			"requestId": "6d68ca91-49c9-448d-89b8-7ca3e6dc66aa",
+			"status": "success",
+			"tracing": {
+				"spanId": "54565fb41ac79632",
+				"type": "X-Amzn-Trace-Id",
+				"value": "Root=1-62e900b2-710d76f009d6e7785905449a;Parent=0efbd19962d95b05;Sampled=1"
+			},
+			"spans": [
+				{
+					"name": "responseLatency",
+					"start": "2022-10-12T00:01:14.500Z",
+					"durationMs": 23.02
+				}
+			],
+			"metrics": {
+				"durationMs": 140.0,
+				"producedBytes": 16
+			}
+		}
+	}
+	`)
+
+	var le LogEvent
+	err := json.Unmarshal(jsonBytes, &le)
+	if err != nil {
+		t.Fail()
+	}
+
+	err = le.unmarshalRecord()
+	assert.NoError(t, err)
+
+	assert.Equal(t, "6d68ca91-49c9-448d-89b8-7ca3e6dc66aa", le.Record.RequestId)
+	assert.Equal(t, "success", le.Record.Status)
+	assert.Equal(t, PlatformMetrics{DurationMs: 140, ProducedBytes: 16}, le.Record.Metrics)
+	assert.Equal(t, []PlatformSpan{{
+		Name:       "responseLatency",
+		Start:      time.Date(2022, 10, 12, 0, 1, 14, 500000000, time.UTC),
+		DurationMs: 23.02,
+	}}, le.Record.Spans)
+	assert.Equal(t, &PlatformTracing{
+		SpanId: "54565fb41ac79632",
+		Type:   "X-Amzn-Trace-Id",
+		Value:  "Root=1-62e900b2-710d76f009d6e7785905449a;Parent=0efbd19962d95b05;Sampled=1",
+	}, le.Record.Tracing)
+}
+
+func Test_unmarshalTelemetryInitStartRecord(t *testing.T) {
+	jsonBytes := []byte(`
+	{
+		"time": "2022-10-12T00:00:15.064Z",
+		"type": "platform.initStart",
+		"record": {
+			"initializationType": "on-demand",
+			"phase": "init",
+			"runtimeVersion": "nodejs-14.v3"
+		}
+	}
+	`)
+
+	var le LogEvent
+	err := json.Unmarshal(jsonBytes, &le)
+	if err != nil {
+		t.Fail()
+	}
+
+	err = le.unmarshalRecord()
+	assert.NoError(t, err)
+	assert.Equal(t, LogEventRecord{InitializationType: "on-demand", Phase: "init", RuntimeVersion: "nodejs-14.v3"}, le.Record)
+}
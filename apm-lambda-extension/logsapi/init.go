@@ -19,6 +19,7 @@ package logsapi
 
 import (
 	"fmt"
+	"log"
 	"os"
 
 	"github.com/pkg/errors"
@@ -26,36 +27,66 @@ import (
 
 const DefaultHttpListenerPort = "1234"
 
-// Init initializes the configuration for the Logs API and subscribes to the Logs API for HTTP
-func Subscribe(extensionID string, eventTypes []EventType) error {
+// Init initializes the configuration for the Logs API and subscribes to the Telemetry API
+// or the Logs API for HTTP. Subscribing to the Telemetry API falls back to the Logs API
+// where the Telemetry API is not available. Returns the API subscribed to.
+func Subscribe(extensionID string, eventTypes []EventType, bufferingCfg BufferingCfg, api SubscriptionAPI, protocol HttpProtocol) (SubscriptionAPI, error) {
 	extensions_api_address, ok := os.LookupEnv("AWS_LAMBDA_RUNTIME_API")
 	if !ok {
-		return errors.New("AWS_LAMBDA_RUNTIME_API is not set")
+		return "", errors.New("AWS_LAMBDA_RUNTIME_API is not set")
 	}
 
 	logsAPIBaseUrl := fmt.Sprintf("http://%s", extensions_api_address)
 
 	logsAPIClient, err := NewClient(logsAPIBaseUrl)
 	if err != nil {
-		return err
+		return "", err
 	}
 
-	bufferingCfg := BufferingCfg{
-		MaxItems:  10000,
-		MaxBytes:  262144,
-		TimeoutMS: 25,
-	}
-	if err != nil {
-		return err
-	}
 	address := ListenOnAddress()
+
+	if api == TelemetryAPI {
+		telemetryDestination := Destination{
+			Protocol: protocol,
+			URI:      destinationURI(protocol, address),
+		}
+		_, err = logsAPIClient.SubscribeTelemetry(eventTypes, bufferingCfg, telemetryDestination, extensionID)
+		if err == nil {
+			logSubscription(TelemetryAPI, protocol, eventTypes, bufferingCfg)
+			return TelemetryAPI, nil
+		}
+		log.Printf("Could not subscribe to the Telemetry API, falling back to the Logs API: %v", err)
+	}
+
 	destination := Destination{
-		Protocol:   HttpProto,
-		URI:        URI("http://" + address),
-		HttpMethod: HttpPost,
-		Encoding:   JSON,
+		Protocol: protocol,
+		URI:      destinationURI(protocol, address),
+	}
+	if protocol == HttpProto {
+		destination.HttpMethod = HttpPost
+		destination.Encoding = JSON
 	}
 
 	_, err = logsAPIClient.Subscribe(eventTypes, bufferingCfg, destination, extensionID)
-	return err
+	if err != nil {
+		return LogsAPI, err
+	}
+	logSubscription(LogsAPI, protocol, eventTypes, bufferingCfg)
+	return LogsAPI, nil
+}
+
+// destinationURI is the URI the events are delivered to. TCP destinations
+// take the address of the listener without a scheme.
+func destinationURI(protocol HttpProtocol, address string) URI {
+	if protocol == TcpProto {
+		return URI(address)
+	}
+	return URI("http://" + address)
+}
+
+// logSubscription logs the effective subscription, to help tuning the latency
+// of the events against the overhead of receiving them
+func logSubscription(api SubscriptionAPI, protocol HttpProtocol, eventTypes []EventType, bufferingCfg BufferingCfg) {
+	log.Printf("Subscribed to the %s API for %v events over %s, buffered up to %d events, %d bytes or %dms",
+		api, eventTypes, protocol, bufferingCfg.MaxItems, bufferingCfg.MaxBytes, bufferingCfg.TimeoutMS)
 }
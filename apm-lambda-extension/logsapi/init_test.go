@@ -0,0 +1,113 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package logsapi
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newRuntimeAPI starts a fake Lambda runtime API, answering subscription
+// requests to the given paths with the status code
+func newRuntimeAPI(t *testing.T, statusCodes map[string]int, requests map[string]SubscribeRequest) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "test-extension", r.Header.Get(lambdaAgentIdentifierHeaderKey))
+		body, _ := ioutil.ReadAll(r.Body)
+		var request SubscribeRequest
+		assert.NoError(t, json.Unmarshal(body, &request))
+		requests[r.URL.Path] = request
+		w.WriteHeader(statusCodes[r.URL.Path])
+	}))
+	os.Setenv("AWS_LAMBDA_RUNTIME_API", strings.TrimPrefix(server.URL, "http://"))
+	return server
+}
+
+func TestSubscribeTelemetryAPI(t *testing.T) {
+	defer os.Unsetenv("AWS_LAMBDA_RUNTIME_API")
+	requests := make(map[string]SubscribeRequest)
+	server := newRuntimeAPI(t, map[string]int{"/2022-07-01/telemetry": http.StatusOK}, requests)
+	defer server.Close()
+
+	api, err := Subscribe("test-extension", []EventType{Platform, Function}, DefaultBufferingCfg, TelemetryAPI, HttpProto)
+	assert.NoError(t, err)
+	assert.Equal(t, TelemetryAPI, api)
+	assert.Equal(t, 1, len(requests))
+
+	request := requests["/2022-07-01/telemetry"]
+	assert.Equal(t, SchemaVersion(SchemaVersion20220701), request.SchemaVersion)
+	assert.Equal(t, []EventType{Platform, Function}, request.EventTypes)
+	assert.Equal(t, HttpMethod(""), request.Destination.HttpMethod)
+}
+
+func TestSubscribeFallsBackToLogsAPI(t *testing.T) {
+	defer os.Unsetenv("AWS_LAMBDA_RUNTIME_API")
+	requests := make(map[string]SubscribeRequest)
+	server := newRuntimeAPI(t, map[string]int{
+		"/2022-07-01/telemetry": http.StatusNotFound,
+		"/2020-08-15/logs":      http.StatusOK,
+	}, requests)
+	defer server.Close()
+
+	api, err := Subscribe("test-extension", []EventType{Platform}, DefaultBufferingCfg, TelemetryAPI, HttpProto)
+	assert.NoError(t, err)
+	assert.Equal(t, LogsAPI, api)
+	assert.Equal(t, 2, len(requests))
+
+	request := requests["/2020-08-15/logs"]
+	assert.Equal(t, SchemaVersion(SchemaVersionLatest), request.SchemaVersion)
+	assert.Equal(t, HttpPost, request.Destination.HttpMethod)
+}
+
+func TestSubscribeLogsAPI(t *testing.T) {
+	defer os.Unsetenv("AWS_LAMBDA_RUNTIME_API")
+	requests := make(map[string]SubscribeRequest)
+	server := newRuntimeAPI(t, map[string]int{"/2020-08-15/logs": http.StatusOK}, requests)
+	defer server.Close()
+
+	api, err := Subscribe("test-extension", []EventType{Platform}, DefaultBufferingCfg, LogsAPI, HttpProto)
+	assert.NoError(t, err)
+	assert.Equal(t, LogsAPI, api)
+	assert.Equal(t, 1, len(requests))
+	_, ok := requests["/2020-08-15/logs"]
+	assert.True(t, ok)
+}
+
+func TestSubscribeTCP(t *testing.T) {
+	defer os.Unsetenv("AWS_LAMBDA_RUNTIME_API")
+	os.Setenv("ELASTIC_APM_LAMBDA_LOGS_LISTENER_ADDRESS", "sandbox:4243")
+	defer os.Unsetenv("ELASTIC_APM_LAMBDA_LOGS_LISTENER_ADDRESS")
+	requests := make(map[string]SubscribeRequest)
+	server := newRuntimeAPI(t, map[string]int{
+		"/2022-07-01/telemetry": http.StatusNotFound,
+		"/2020-08-15/logs":      http.StatusOK,
+	}, requests)
+	defer server.Close()
+
+	api, err := Subscribe("test-extension", []EventType{Platform}, DefaultBufferingCfg, TelemetryAPI, TcpProto)
+	assert.NoError(t, err)
+	assert.Equal(t, LogsAPI, api)
+	assert.Equal(t, Destination{Protocol: TcpProto, URI: "sandbox:4243"}, requests["/2022-07-01/telemetry"].Destination)
+	assert.Equal(t, Destination{Protocol: TcpProto, URI: "sandbox:4243"}, requests["/2020-08-15/logs"].Destination)
+}
@@ -0,0 +1,149 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package logsapi
+
+import (
+	"bufio"
+	"encoding/json"
+	"log"
+	"net"
+	"sync"
+)
+
+// maxTCPLineBytes is the largest event accepted on a TCP connection. Events
+// are buffered by Lambda up to 1048576 bytes, so that no event can be larger.
+const maxTCPLineBytes = 1048576
+
+// LogsAPIListener receives the events of the Logs API or the Telemetry API,
+// and puts them into the log queue
+type LogsAPIListener interface {
+	Start(address string) (bool, error)
+	Shutdown()
+}
+
+// NewLogsAPIListener returns a listener for the given destination protocol
+func NewLogsAPIListener(protocol HttpProtocol, lc chan LogEvent) (LogsAPIListener, error) {
+	if protocol == TcpProto {
+		return NewLogsAPITCPListener(lc)
+	}
+	return NewLogsAPIHttpListener(lc)
+}
+
+// LogsAPITCPListener is used to listen to the Logs API using TCP. Events are
+// streamed as newline-delimited JSON, one event per line.
+type LogsAPITCPListener struct {
+	sync.Mutex
+	listener net.Listener
+	conns    map[net.Conn]bool
+
+	logChannel chan LogEvent
+}
+
+// NewLogsAPITCPListener returns a LogsAPITCPListener with the given log queue
+func NewLogsAPITCPListener(lc chan LogEvent) (*LogsAPITCPListener, error) {
+	return &LogsAPITCPListener{
+		conns:      make(map[net.Conn]bool),
+		logChannel: lc,
+	}, nil
+}
+
+// Start listens on the address, and accepts connections in a goroutine
+func (s *LogsAPITCPListener) Start(address string) (bool, error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return false, err
+	}
+	s.Lock()
+	s.listener = listener
+	s.Unlock()
+
+	go func() {
+		log.Printf("Server listening for logs data from AWS Logs API on tcp %s", listener.Addr())
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				log.Printf("Logs API TCP listener closed: %v", err)
+				return
+			}
+			s.Lock()
+			s.conns[conn] = true
+			s.Unlock()
+			go s.handleConn(conn)
+		}
+	}()
+	return true, nil
+}
+
+// Addr returns the address the listener listens on, once started
+func (s *LogsAPITCPListener) Addr() net.Addr {
+	s.Lock()
+	defer s.Unlock()
+	if s.listener == nil {
+		return nil
+	}
+	return s.listener.Addr()
+}
+
+// handleConn reads the events streamed on the connection, and puts them into
+// the log queue in the order they were sent. As for the HTTP listener,
+// logging besides the error cases is not recommended.
+func (s *LogsAPITCPListener) handleConn(conn net.Conn) {
+	defer func() {
+		conn.Close()
+		s.Lock()
+		delete(s.conns, conn)
+		s.Unlock()
+	}()
+
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxTCPLineBytes)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+		var logEvent LogEvent
+		if err := json.Unmarshal(line, &logEvent); err != nil {
+			log.Println("error unmarshaling log event:", err)
+			continue
+		}
+		if err := logEvent.unmarshalRecord(); err != nil {
+			log.Printf("Error unmarshalling log event: %+v", err)
+			continue
+		}
+		s.logChannel <- logEvent
+	}
+	if err := scanner.Err(); err != nil {
+		log.Printf("Error reading Logs API TCP connection: %v", err)
+	}
+}
+
+// Shutdown stops accepting connections, and closes the open ones
+func (s *LogsAPITCPListener) Shutdown() {
+	s.Lock()
+	defer s.Unlock()
+	if s.listener != nil {
+		if err := s.listener.Close(); err != nil {
+			log.Printf("Failed to shutdown Logs API TCP listener %s", err)
+		}
+		s.listener = nil
+	}
+	for conn := range s.conns {
+		conn.Close()
+	}
+}
@@ -0,0 +1,133 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package logsapi
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// startTCPListener starts a TCP listener on a free port
+func startTCPListener(t *testing.T, logChannel chan LogEvent) *LogsAPITCPListener {
+	listener, err := NewLogsAPITCPListener(logChannel)
+	assert.NoError(t, err)
+	_, err = listener.Start("127.0.0.1:0")
+	assert.NoError(t, err)
+	return listener
+}
+
+func receiveLogEvent(t *testing.T, logChannel chan LogEvent) LogEvent {
+	select {
+	case logEvent := <-logChannel:
+		return logEvent
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for log event")
+		return LogEvent{}
+	}
+}
+
+func TestTCPListenerDeliversLogEvents(t *testing.T) {
+	logChannel := make(chan LogEvent)
+	listener := startTCPListener(t, logChannel)
+	defer listener.Shutdown()
+
+	// The fake subscriber streams events as Lambda does, one per line, and
+	// splits lines across writes
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	assert.NoError(t, err)
+	defer conn.Close()
+	conn.Write([]byte(`{"time": "2021-10-20T08:13:03.278Z", "type": "platform.start", "record": {"requestId": "61c0fdeb-f013-4f2a-b627-56278f5666b8"}}` + "\n"))
+	conn.Write([]byte(`{"time": "2021-10-20T08:13:03.279Z", "type": "function", "record": "Hello`))
+	conn.Write([]byte(` world\n"}` + "\n\n"))
+	conn.Write([]byte(`{"time": "2021-10-20T08:13:03.280Z", "type": "platform.runtimeDone", "record": {"requestId": "61c0fdeb-f013-4f2a-b627-56278f5666b8", "status": "success"}}` + "\n"))
+
+	logEvent := receiveLogEvent(t, logChannel)
+	assert.Equal(t, "platform.start", logEvent.Type)
+	assert.Equal(t, "61c0fdeb-f013-4f2a-b627-56278f5666b8", logEvent.Record.RequestId)
+
+	logEvent = receiveLogEvent(t, logChannel)
+	assert.Equal(t, "function", logEvent.Type)
+	assert.Equal(t, `"Hello world\n"`, string(logEvent.RawRecord))
+
+	logEvent = receiveLogEvent(t, logChannel)
+	assert.Equal(t, "platform.runtimeDone", logEvent.Type)
+	assert.Equal(t, LogEventRecord{RequestId: "61c0fdeb-f013-4f2a-b627-56278f5666b8", Status: "success"}, logEvent.Record)
+}
+
+func TestTCPListenerSkipsInvalidLines(t *testing.T) {
+	logChannel := make(chan LogEvent)
+	listener := startTCPListener(t, logChannel)
+	defer listener.Shutdown()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	assert.NoError(t, err)
+	defer conn.Close()
+	conn.Write([]byte("not json\n"))
+	conn.Write([]byte(`{"time": "2021-10-20T08:13:03.278Z", "type": "platform.runtimeDone", "record": "not an object"}` + "\n"))
+	conn.Write([]byte(`{"time": "2021-10-20T08:13:03.278Z", "type": "platform.fault", "record": "Unknown application error occurred"}` + "\n"))
+
+	logEvent := receiveLogEvent(t, logChannel)
+	assert.Equal(t, "platform.fault", logEvent.Type)
+}
+
+func TestTCPListenerAcceptsReconnections(t *testing.T) {
+	logChannel := make(chan LogEvent)
+	listener := startTCPListener(t, logChannel)
+	defer listener.Shutdown()
+
+	for _, requestID := range []string{"first-request", "second-request"} {
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		assert.NoError(t, err)
+		conn.Write([]byte(`{"time": "2021-10-20T08:13:03.278Z", "type": "platform.start", "record": {"requestId": "` + requestID + `"}}` + "\n"))
+		conn.Close()
+		assert.Equal(t, requestID, receiveLogEvent(t, logChannel).Record.RequestId)
+	}
+}
+
+func TestTCPListenerShutdown(t *testing.T) {
+	logChannel := make(chan LogEvent)
+	listener := startTCPListener(t, logChannel)
+	address := listener.Addr().String()
+
+	conn, err := net.Dial("tcp", address)
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	listener.Shutdown()
+	_, err = net.Dial("tcp", address)
+	assert.Error(t, err)
+
+	// The open connection is closed as well
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	assert.Error(t, err)
+}
+
+func TestNewLogsAPIListener(t *testing.T) {
+	logChannel := make(chan LogEvent)
+	listener, err := NewLogsAPIListener(TcpProto, logChannel)
+	assert.NoError(t, err)
+	assert.IsType(t, &LogsAPITCPListener{}, listener)
+
+	listener, err = NewLogsAPIListener(HttpProto, logChannel)
+	assert.NoError(t, err)
+	assert.IsType(t, &LogsAPIHttpListener{}, listener)
+}
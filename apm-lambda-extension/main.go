@@ -20,11 +20,9 @@ package main
 import (
 	"context"
 	"log"
-	"net/http"
 	"os"
 	"os/signal"
 	"path/filepath"
-	"sync"
 	"syscall"
 	"time"
 
@@ -61,32 +59,59 @@ func main() {
 	// pulls ELASTIC_ env variable into globals for easy access
 	config := extension.ProcessEnv()
 
-	// Create a channel to buffer apm agent data
-	agentDataChannel := make(chan extension.AgentData, 100)
+	// Open the spool for agent data that could not be delivered
+	if err = extension.InitSpool(config); err != nil {
+		log.Printf("Could not open spool, undelivered agent data will be dropped: %v", err)
+	}
 
-	// Start http server to receive data from agent
-	extension.StartHttpServer(agentDataChannel, config)
+	// Create a buffer for apm agent data
+	agentDataBuffer := extension.NewAgentDataBuffer(config.AgentDataBufferSize, config.AgentDataBufferBytes, config.AgentDataBufferOverflow)
 
 	// Create a client to use for sending data to the apm server
-	client := &http.Client{
-		Transport: http.DefaultTransport.(*http.Transport).Clone(),
+	client, err := extension.NewApmServerClient(config)
+	if err != nil {
+		log.Fatalf("Could not configure the connection to the APM server, exiting: %v", err)
+	}
+
+	// Start sending a copy of agent data to the secondary APM servers, before
+	// the http server can hand any agent data over to them
+	extension.StartSecondaryDestinations(client, config)
+
+	// Start http server to receive data from agent
+	extension.StartHttpServer(client, agentDataBuffer, config)
+
+	// Create a stream to send agent data through a single request per invocation
+	var stream *extension.ApmServerStream
+	if config.StreamAgentData {
+		stream = extension.NewApmServerStream(client, agentDataBuffer, config)
 	}
 
 	// Make channel for collecting logs and create a HTTP server to listen for them
 	logsChannel := make(chan logsapi.LogEvent)
 
-	// Use a wait group to ensure the background go routine sending to the APM server
-	// completes before signaling that the extension is ready for the next invocation.
-	var backgroundDataSendWg sync.WaitGroup
+	// Forward the function logs to the APM server, if enabled
+	var functionLogs *extension.FunctionLogForwarder
+	if config.SendFunctionLogs {
+		functionLogs = extension.NewFunctionLogForwarder(agentDataBuffer)
+	}
+
+	// Report the metrics of each invocation to the APM server, if enabled
+	var platformMetrics *extension.PlatformMetricsReporter
+	if config.SendPlatformMetrics {
+		platformMetrics = extension.NewPlatformMetricsReporter(agentDataBuffer)
+	}
 
-	// Subscribe to the Logs API
-	err = logsapi.Subscribe(
+	// Subscribe to the Telemetry API, or to the Logs API
+	_, err = logsapi.Subscribe(
 		extensionClient.ExtensionID,
-		[]logsapi.EventType{logsapi.Platform})
+		config.SubscriptionTypes,
+		config.SubscriptionBuffering,
+		config.SubscriptionAPI,
+		config.LogsListenerProtocol)
 	if err != nil {
 		log.Printf("Could not subscribe to the logs API.")
 	} else {
-		logsAPIListener, err := logsapi.NewLogsAPIHttpListener(logsChannel)
+		logsAPIListener, err := logsapi.NewLogsAPIListener(config.LogsListenerProtocol, logsChannel)
 		if err != nil {
 			log.Printf("Error while creating Logs API listener: %v", err)
 		}
@@ -98,6 +123,48 @@ func main() {
 		}
 	}
 
+	// Receive Logs API events for the lifetime of the extension, as function
+	// logs may arrive after the invocation they belong to has ended.
+	// Signal the invocation in progress when its runtimeDone event is received.
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case logEvent := <-logsChannel:
+				if functionLogs != nil {
+					functionLogs.Process(logEvent)
+				}
+				if platformMetrics != nil {
+					platformMetrics.Process(logEvent)
+				}
+				if logsapi.EventType(logEvent.Type) == logsapi.Function {
+					continue
+				}
+				log.Printf("Received log event %v\n", logEvent.Type)
+				// Check the logEvent for runtimeDone and compare the RequestID
+				// to the id that came in via the Next API
+				if logsapi.SubEventType(logEvent.Type) == logsapi.RuntimeDone {
+					invocation := extension.CurrentInvocation()
+					if invocation != nil && logEvent.Record.RequestId == invocation.RequestID {
+						log.Println("Received runtimeDone event for this function invocation")
+						invocation.SignalRuntimeDone()
+					} else {
+						log.Println("Log API runtimeDone event request id didn't match")
+					}
+				}
+			}
+		}
+	}()
+
+	// Keep track of the agent data dropped by the buffer and by the secondary
+	// APM servers, to report overflows,
+	// and of the APM server responses and throttling, to report them per invocation
+	var bufferStats extension.AgentDataBufferStats
+	var secondaryStats extension.SecondaryStats
+	var intakeStats extension.IntakeStats
+	var throttleStats extension.ThrottleStats
+
 	for {
 		select {
 		case <-ctx.Done():
@@ -114,95 +181,145 @@ func main() {
 			}
 			log.Printf("Received event: %v\n", extension.PrettyPrint(event))
 
-			// Make a channel for signaling that we received the agent flushed signal
-			extension.AgentDoneSignal = make(chan struct{})
-			// Make a channel for signaling that we received the runtimeDone logs API event
-			runtimeDoneSignal := make(chan struct{})
-			// Make a channel for signaling that the function invocation is complete
-			funcDone := make(chan struct{})
+			// Calculate the deadline for flushing data to the APM server, leaving
+			// some headroom before the invocation times out, or before the
+			// extension is shut down. Sends still in flight at the deadline are
+			// cancelled, and their agent data is kept for a later attempt.
+			invocation := extension.StartInvocation(event.RequestID, time.Unix(0, event.DeadlineMs*int64(time.Millisecond)))
+			flushDeadline := invocation.Deadline.Add(-config.FlushDeadlineMargin)
+			invocationCtx, cancelInvocation := context.WithDeadline(ctx, flushDeadline)
+
+			// Replay agent data that could not be delivered on earlier invocations
+			// before sending any new data. If some of it is left, new data is not
+			// sent during this invocation, but spooled behind it.
+			spoolReplayed := extension.ReplaySpool(invocationCtx, client, config)
+			flushAPMData := func() {
+				if spoolReplayed {
+					extension.FlushAPMData(invocationCtx, client, agentDataBuffer, config)
+				} else {
+					extension.SpoolAgentData(agentDataBuffer, extension.ErrSpoolNotReplayed)
+				}
+			}
+
+			// Before shutting down, add the function logs received since the last
+			// invocation ended to the data that is flushed
+			if event.EventType == extension.Shutdown && functionLogs != nil {
+				functionLogs.Flush()
+			}
 
 			// Flush any APM data, in case waiting for the agentDone or runtimeDone signals
 			// timed out, the agent data wasn't available yet, and we got to the next event
-			extension.FlushAPMData(client, agentDataChannel, config)
+			flushAPMData()
 
 			// A shutdown event indicates the execution environment is shutting down.
 			// This is usually due to inactivity.
 			if event.EventType == extension.Shutdown {
+				// Keep the agent data that could not be sent for a later attempt
+				extension.SpoolAgentData(agentDataBuffer, extension.ErrShuttingDown)
+				extension.WaitForSecondaryDestinations(invocationCtx, config)
+				cancelInvocation()
+				invocation.End()
 				extension.ProcessShutdown()
 				return
 			}
 
 			// Receive agent data as it comes in and post it to the APM server.
 			// Stop checking for, and sending agent data when the function invocation
-			// has completed, signaled via a channel.
+			// has completed, signaled via a channel, once the buffer is empty.
+			// The go routine is waited for before the stream is closed, so that
+			// no new stream is opened afterwards.
+			stopSending := make(chan struct{})
+			sendingStopped := make(chan struct{})
 			go func() {
+				defer close(sendingStopped)
 				for {
-					select {
-					case <-funcDone:
-						log.Println("funcDone signal received, not processing any more agent data")
+					agentData, ok := agentDataBuffer.Get(stopSending)
+					if !ok {
+						log.Println("Invocation done, not processing any more agent data")
 						return
-					case agentData := <-agentDataChannel:
-						backgroundDataSendWg.Add(1)
-						err := extension.PostToApmServer(client, agentData, config)
-						if err != nil {
-							log.Printf("Error sending to APM server, skipping: %v", err)
-						}
-						backgroundDataSendWg.Done()
 					}
-				}
-			}()
-
-			// Receive Logs API events
-			// Send to the runtimeDoneSignal channel to signal when a runtimeDone event is received
-			go func() {
-				for {
-					select {
-					case <-funcDone:
-						log.Println("funcDone signal received, not processing any more log events")
+					var err error
+					if !spoolReplayed {
+						extension.SpoolAgentData(agentDataBuffer, extension.ErrSpoolNotReplayed, agentData)
+					} else if stream != nil {
+						err = stream.Send(invocationCtx, agentData)
+					} else {
+						err = extension.SendAgentData(invocationCtx, client, agentData, agentDataBuffer, config)
+					}
+					if err != nil {
+						log.Printf("Not sending any more agent data during this invocation: %v", err)
 						return
-					case logEvent := <-logsChannel:
-						log.Printf("Received log event %v\n", logEvent.Type)
-						// Check the logEvent for runtimeDone and compare the RequestID
-						// to the id that came in via the Next API
-						if logsapi.SubEventType(logEvent.Type) == logsapi.RuntimeDone {
-							if logEvent.Record.RequestId == event.RequestID {
-								log.Println("Received runtimeDone event for this function invocation")
-								runtimeDoneSignal <- struct{}{}
-								return
-							} else {
-								log.Println("Log API runtimeDone event request id didn't match")
-							}
-						}
 					}
 				}
 			}()
 
-			// Calculate how long to wait for a runtimeDoneSignal or AgentDoneSignal signal
-			flushDeadlineMs := event.DeadlineMs - 100
-			durationUntilFlushDeadline := time.Until(time.Unix(flushDeadlineMs/1000, 0))
-
-			// Create a timer that expires after durationUntilFlushDeadline
-			timer := time.NewTimer(durationUntilFlushDeadline)
-			defer timer.Stop()
-
+			// Wait for the agent done or runtimeDone signal until the flush deadline.
+			// Agents may still be sending their data once the runtime is done, so
+			// keep waiting a short grace period for the registered agents that did
+			// not flush yet.
 			select {
-			case <-extension.AgentDoneSignal:
-				log.Println("Received agent done signal")
-			case <-runtimeDoneSignal:
+			case <-invocation.AgentDone():
+				log.Println("Received agent done signal from every agent")
+			case <-invocation.RuntimeDone():
 				log.Println("Received runtimeDone signal")
-			case <-timer.C:
+				if len(invocation.PendingAgents()) > 0 {
+					gracePeriod := time.NewTimer(config.AgentFlushGracePeriod)
+					select {
+					case <-invocation.AgentDone():
+						log.Println("Received agent done signal from every agent")
+					case <-gracePeriod.C:
+						log.Println("Grace period expired waiting for agent signal after runtimeDone event")
+					case <-invocationCtx.Done():
+						log.Println("Time expired waiting for agent signal after runtimeDone event")
+					}
+					gracePeriod.Stop()
+				}
+			case <-invocationCtx.Done():
 				log.Println("Time expired waiting for agent signal or runtimeDone event")
 			}
+			invocation.ReportPendingAgents()
+			invocation.ExpireAgents(config)
 
-			backgroundDataSendWg.Wait()
+			// Send the function logs received so far along with the agent data
+			if functionLogs != nil {
+				functionLogs.Flush()
+			}
+
+			close(stopSending)
+			<-sendingStopped
 			if config.SendStrategy == extension.SyncFlush {
 				// Flush APM data now that the function invocation has completed
-				extension.FlushAPMData(client, agentDataChannel, config)
+				flushAPMData()
+			}
+
+			// End the stream before the sandbox is frozen
+			if stream != nil {
+				stream.Close(invocationCtx)
+			}
+
+			// Give the secondary APM servers a short grace period, once the data
+			// has been sent to the primary APM server
+			extension.WaitForSecondaryDestinations(invocationCtx, config)
+			cancelInvocation()
+
+			if stats := extension.GetIntakeStats(); stats != intakeStats {
+				log.Printf("APM server intake totals so far: %v", stats)
+				intakeStats = stats
+			}
+			if stats := extension.GetThrottleStats(); stats != throttleStats {
+				log.Printf("APM server throttled requests during this invocation, totals so far: %v", stats)
+				throttleStats = stats
+			}
+			if stats := agentDataBuffer.Stats(); stats != bufferStats {
+				log.Printf("Agent data buffer overflowed during this invocation, totals so far: %v", stats)
+				bufferStats = stats
+			}
+			if stats := extension.GetSecondaryStats(); stats != secondaryStats {
+				log.Printf("Secondary APM servers dropped agent data during this invocation, totals so far: %v", stats)
+				secondaryStats = stats
 			}
 
-			close(funcDone)
-			close(runtimeDoneSignal)
-			close(extension.AgentDoneSignal)
+			invocation.End()
 		}
 	}
 }